@@ -7,8 +7,10 @@ import (
 )
 
 var (
-	DBMessageType      = []string{"Message", "File", "Event", "Other"}
-	DBNotificationType = []string{"GroupEvent", "GroupRequest", "Other"}
+	DBMessageType      = []string{"Message", "File", "Poll", "Event", "Other"}
+	DBNotificationType = []string{"GroupEvent", "GroupRequest", "Reply", "Mention", "Other"}
+	DBScheduledStatus  = []string{"Pending", "Sending", "Sent", "Canceled", "Failed"}
+	DBUploadStatus     = []string{"Uploading", "Committing", "Committed"}
 
 	groupMetadata = table.Metadata{
 		Name:    "group",
@@ -16,6 +18,12 @@ var (
 		PartKey: []string{"id"},
 		SortKey: []string{},
 	}
+	groupSettingMetadata = table.Metadata{
+		Name:    "group_setting",
+		Columns: []string{"group_id", "message_ttl", "time_created"},
+		PartKey: []string{"group_id"},
+		SortKey: []string{},
+	}
 	//participantByGroupMetadata = table.Metadata{
 	//	Name:    "participant_by_account",
 	//	Columns: []string{"group_id", "time_created", "accountinfo_id", "notify", "role"},
@@ -28,24 +36,140 @@ var (
 	//	PartKey: []string{"accountinfo_id"},
 	//	SortKey: []string{"group_id", "time_created"},
 	//}
+	// The message tables are created by the EchoChat backend (see the Database section of the README). Like the other
+	// "_by_" tables, message_by_group is partitioned by group, and message_by_account by account.
 	messageByGroupMetadata = table.Metadata{
-		Name:    "message_by_group",
-		Columns: []string{"accountinfo_id", "time_created", "group_id", "content", "type", "accountinfo_name", "group_name"},
+		Name: "message_by_group",
+		Columns: []string{"group_id", "time_created", "accountinfo_id", "content", "type", "accountinfo_name", "group_name", "time_edited", "deleted",
+			"reply_to_time_created", "reply_to_accountinfo_id", "mentions", "mention_all", "time_expired", "forwarded_group_id",
+			"forwarded_time_created", "forwarded_accountinfo_id", "file_id", "file_size", "file_mime"},
+		PartKey: []string{"group_id"},
+		SortKey: []string{"time_created", "accountinfo_id"},
+	}
+	messageByAccountMetadata = table.Metadata{
+		Name: "message_by_account",
+		Columns: []string{"accountinfo_id", "time_created", "group_id", "content", "type", "accountinfo_name", "group_name", "time_edited", "deleted",
+			"reply_to_time_created", "reply_to_accountinfo_id", "mentions", "mention_all", "time_expired", "forwarded_group_id",
+			"forwarded_time_created", "forwarded_accountinfo_id", "file_id", "file_size", "file_mime"},
 		PartKey: []string{"accountinfo_id"},
 		SortKey: []string{"time_created", "group_id"},
 	}
-	messageByAccountMetadata = table.Metadata{
-		Name:    "message_by_account",
-		Columns: []string{"group_id", "time_created", "accountinfo_id", "content", "type", "accountinfo_name", "group_name"},
-		PartKey: []string{"group_id"},
+	messageReplyMetadata = table.Metadata{
+		Name:    "message_reply",
+		Columns: []string{"group_id", "reply_to_time_created", "reply_to_accountinfo_id", "time_created", "accountinfo_id"},
+		PartKey: []string{"group_id", "reply_to_time_created", "reply_to_accountinfo_id"},
 		SortKey: []string{"time_created", "accountinfo_id"},
 	}
+	messageDedupeMetadata = table.Metadata{
+		Name:    "message_dedupe",
+		Columns: []string{"accountinfo_id", "client_message_id", "group_id", "time_created", "scheduled_id"},
+		PartKey: []string{"accountinfo_id", "client_message_id"},
+		SortKey: []string{},
+	}
+	messageReactionMetadata = table.Metadata{
+		Name:    "message_reaction",
+		Columns: []string{"group_id", "message_time_created", "message_accountinfo_id", "reaction", "accountinfo_id", "time_created"},
+		PartKey: []string{"group_id", "message_time_created", "message_accountinfo_id"},
+		SortKey: []string{"reaction", "accountinfo_id"},
+	}
+	pollMetadata = table.Metadata{
+		Name:    "poll",
+		Columns: []string{"group_id", "message_time_created", "message_accountinfo_id", "options", "multiple_choice", "time_closed"},
+		PartKey: []string{"group_id", "message_time_created", "message_accountinfo_id"},
+		SortKey: []string{},
+	}
+	pollVoteMetadata = table.Metadata{
+		Name:    "poll_vote",
+		Columns: []string{"group_id", "message_time_created", "message_accountinfo_id", "accountinfo_id", "choices", "time_created"},
+		PartKey: []string{"group_id", "message_time_created", "message_accountinfo_id"},
+		SortKey: []string{"accountinfo_id"},
+	}
+	messagePinMetadata = table.Metadata{
+		Name:    "message_pin",
+		Columns: []string{"group_id", "message_time_created", "message_accountinfo_id", "accountinfo_id", "time_created"},
+		PartKey: []string{"group_id"},
+		SortKey: []string{"message_time_created", "message_accountinfo_id"},
+	}
+	messageDeliveryMetadata = table.Metadata{
+		Name:    "message_delivery",
+		Columns: []string{"group_id", "message_time_created", "message_accountinfo_id", "accountinfo_id", "time_created"},
+		PartKey: []string{"group_id", "message_time_created", "message_accountinfo_id"},
+		SortKey: []string{"accountinfo_id"},
+	}
+	participantMuteMetadata = table.Metadata{
+		Name:    "participant_mute",
+		Columns: []string{"group_id", "accountinfo_id", "mute_until", "time_created"},
+		PartKey: []string{"group_id"},
+		SortKey: []string{"accountinfo_id"},
+	}
+	readMarkerMetadata = table.Metadata{
+		Name:    "read_marker",
+		Columns: []string{"group_id", "accountinfo_id", "time_read", "time_created"},
+		PartKey: []string{"group_id"},
+		SortKey: []string{"accountinfo_id"},
+	}
+	scheduledMessageByTimeMetadata = table.Metadata{
+		Name: "scheduled_message_by_time",
+		Columns: []string{"bucket", "send_at", "id", "accountinfo_id", "accountinfo_name", "group_id", "data", "status", "time_claimed",
+			"time_created"},
+		PartKey: []string{"bucket"},
+		SortKey: []string{"send_at", "id"},
+	}
+	scheduledMessageByAccountMetadata = table.Metadata{
+		Name:    "scheduled_message_by_account",
+		Columns: []string{"accountinfo_id", "send_at", "id", "bucket", "group_id"},
+		PartKey: []string{"accountinfo_id"},
+		SortKey: []string{"send_at", "id"},
+	}
+	messageExpiryMetadata = table.Metadata{
+		Name:    "message_expiry",
+		Columns: []string{"bucket", "time_expired", "group_id", "time_created", "accountinfo_id", "file_id"},
+		PartKey: []string{"bucket"},
+		SortKey: []string{"time_expired", "group_id", "time_created", "accountinfo_id"},
+	}
+	fileUploadMetadata = table.Metadata{
+		Name: "file_upload",
+		Columns: []string{"id", "accountinfo_id", "group_id", "filename", "file_size", "file_mime", "checksum", "chunk_size", "received",
+			"status", "message_time_created", "time_claimed", "time_created"},
+		PartKey: []string{"id"},
+		SortKey: []string{},
+	}
+	fileReferenceMetadata = table.Metadata{
+		Name:    "file_reference",
+		Columns: []string{"file_id", "group_id", "time_created", "accountinfo_id"},
+		PartKey: []string{"file_id"},
+		SortKey: []string{"group_id", "time_created", "accountinfo_id"},
+	}
+	uploadExpiryMetadata = table.Metadata{
+		Name:    "upload_expiry",
+		Columns: []string{"bucket", "time_expired", "id", "parts"},
+		PartKey: []string{"bucket"},
+		SortKey: []string{"time_expired", "id"},
+	}
 	notificationMetadata = table.Metadata{
 		Name:    "notification",
 		Columns: []string{"accountinfo_id", "type", "time_created", "group_id", "accountinfo_id_sender", "content"},
 		PartKey: []string{"accountinfo_id"},
 		SortKey: []string{"type", "time_created", "group_id"},
 	}
+	unreadCountMetadata = table.Metadata{
+		Name:    "unread_count",
+		Columns: []string{"accountinfo_id", "group_id", "type", "epoch", "count"},
+		PartKey: []string{"accountinfo_id"},
+		SortKey: []string{"group_id", "type", "epoch"},
+	}
+	unreadEpochMetadata = table.Metadata{
+		Name:    "unread_epoch",
+		Columns: []string{"accountinfo_id", "group_id", "type", "epoch"},
+		PartKey: []string{"accountinfo_id"},
+		SortKey: []string{"group_id", "type"},
+	}
+	unreadExpiryMetadata = table.Metadata{
+		Name:    "unread_expiry",
+		Columns: []string{"bucket", "time_expired", "accountinfo_id", "group_id", "type", "epoch", "time_created"},
+		PartKey: []string{"bucket"},
+		SortKey: []string{"time_expired", "accountinfo_id", "group_id", "type", "epoch", "time_created"},
+	}
 	notificationSeenMetadata = table.Metadata{
 		Name:    "notification_seen",
 		Columns: []string{"accountinfo_id", "type", "group_id", "time_created"},
@@ -56,24 +180,62 @@ var (
 
 // ScyllaDBTables provides metadata for query builder only, not used for creating tables
 type ScyllaDBTables struct {
-	NotificationTable     *table.Table
-	NotificationSeenTable *table.Table
-	MessageByGroupTable   *table.Table
-	MessageByAccountTable *table.Table
+	NotificationTable              *table.Table
+	NotificationSeenTable          *table.Table
+	UnreadCountTable               *table.Table
+	UnreadEpochTable               *table.Table
+	UnreadExpiryTable              *table.Table
+	MessageByGroupTable            *table.Table
+	MessageByAccountTable          *table.Table
+	MessageReplyTable              *table.Table
+	MessageDedupeTable             *table.Table
+	MessageReactionTable           *table.Table
+	MessageDeliveryTable           *table.Table
+	MessagePinTable                *table.Table
+	PollTable                      *table.Table
+	PollVoteTable                  *table.Table
+	ScheduledMessageByTimeTable    *table.Table
+	ScheduledMessageByAccountTable *table.Table
+	FileUploadTable                *table.Table
+	FileReferenceTable             *table.Table
+	UploadExpiryTable              *table.Table
+	MessageExpiryTable             *table.Table
+	ReadMarkerTable                *table.Table
+	ParticipantMuteTable           *table.Table
 	//ParticipantByAccountTable *table.Table
 	//ParticipantByGroupTable   *table.Table
-	GroupTable *table.Table
+	GroupTable        *table.Table
+	GroupSettingTable *table.Table
 }
 
 func InitScyllaDBTables() *ScyllaDBTables {
 	return &ScyllaDBTables{
-		NotificationTable:     table.New(notificationMetadata),
-		NotificationSeenTable: table.New(notificationSeenMetadata),
-		MessageByGroupTable:   table.New(messageByGroupMetadata),
-		MessageByAccountTable: table.New(messageByAccountMetadata),
+		NotificationTable:              table.New(notificationMetadata),
+		NotificationSeenTable:          table.New(notificationSeenMetadata),
+		UnreadCountTable:               table.New(unreadCountMetadata),
+		UnreadEpochTable:               table.New(unreadEpochMetadata),
+		UnreadExpiryTable:              table.New(unreadExpiryMetadata),
+		MessageByGroupTable:            table.New(messageByGroupMetadata),
+		MessageByAccountTable:          table.New(messageByAccountMetadata),
+		MessageReplyTable:              table.New(messageReplyMetadata),
+		MessageDedupeTable:             table.New(messageDedupeMetadata),
+		MessageReactionTable:           table.New(messageReactionMetadata),
+		MessageDeliveryTable:           table.New(messageDeliveryMetadata),
+		MessagePinTable:                table.New(messagePinMetadata),
+		PollTable:                      table.New(pollMetadata),
+		PollVoteTable:                  table.New(pollVoteMetadata),
+		ScheduledMessageByTimeTable:    table.New(scheduledMessageByTimeMetadata),
+		ScheduledMessageByAccountTable: table.New(scheduledMessageByAccountMetadata),
+		FileUploadTable:                table.New(fileUploadMetadata),
+		FileReferenceTable:             table.New(fileReferenceMetadata),
+		UploadExpiryTable:              table.New(uploadExpiryMetadata),
+		MessageExpiryTable:             table.New(messageExpiryMetadata),
+		ReadMarkerTable:                table.New(readMarkerMetadata),
+		ParticipantMuteTable:           table.New(participantMuteMetadata),
 		//ParticipantByAccountTable: table.New(participantByAccountMetadata),
 		//ParticipantByGroupTable:   table.New(participantByGroupMetadata),
-		GroupTable: table.New(groupMetadata),
+		GroupTable:        table.New(groupMetadata),
+		GroupSettingTable: table.New(groupSettingMetadata),
 	}
 }
 
@@ -85,6 +247,13 @@ type Group struct {
 	TimeCreated time.Time  `db:"time_created" json:"time_created"`
 }
 
+// GroupSetting keeps the settings of a group which are managed by this service.
+type GroupSetting struct {
+	GroupID     gocql.UUID `db:"group_id" json:"group_id"`
+	MessageTTL  int        `db:"message_ttl" json:"message_ttl"` // in seconds, 0 if the messages never expire
+	TimeCreated time.Time  `db:"time_created" json:"time_created"`
+}
+
 type Participant struct {
 	AccountinfoID int        `db:"accountinfo_id"`
 	GroupID       gocql.UUID `db:"group_id"`
@@ -93,6 +262,15 @@ type Participant struct {
 	Role          string     `db:"role"`
 }
 
+// ParticipantMute mutes the notifications of a group for a participant until a given time.
+// The row expires at that time.
+type ParticipantMute struct {
+	GroupID       gocql.UUID `db:"group_id"`
+	AccountinfoID int        `db:"accountinfo_id"`
+	MuteUntil     time.Time  `db:"mute_until"`
+	TimeCreated   time.Time  `db:"time_created"`
+}
+
 type Message struct {
 	GroupID         gocql.UUID `db:"group_id" json:"group_id"`
 	TimeCreated     time.Time  `db:"time_created" json:"time_created"`
@@ -101,13 +279,232 @@ type Message struct {
 	Type            string     `db:"type" json:"type"`
 	AccountinfoName string     `db:"accountinfo_name" json:"accountinfo_name"`
 	GroupName       string     `db:"group_name" json:"group_name"`
+	TimeEdited      *time.Time `db:"time_edited" json:"time_edited,omitempty"`
+	Deleted         bool       `db:"deleted" json:"deleted,omitempty"`
+	// the parent message in the same group, if the message is a reply
+	ReplyToTimeCreated   *time.Time `db:"reply_to_time_created" json:"reply_to_time_created,omitempty"`
+	ReplyToAccountinfoID *int       `db:"reply_to_accountinfo_id" json:"reply_to_accountinfo_id,omitempty"`
+	// the participants mentioned in the content, MentionAll if an admin mentioned everyone with @all
+	Mentions   []int `db:"mentions" json:"mentions,omitempty"`
+	MentionAll bool  `db:"mention_all" json:"mention_all,omitempty"`
+	// the time the ephemeral message expires, nil if it never does
+	TimeExpired *time.Time `db:"time_expired" json:"time_expired,omitempty"`
+	// the original message, if the message was forwarded from another group
+	ForwardedGroupID       *gocql.UUID `db:"forwarded_group_id" json:"forwarded_group_id,omitempty"`
+	ForwardedTimeCreated   *time.Time  `db:"forwarded_time_created" json:"forwarded_time_created,omitempty"`
+	ForwardedAccountinfoID *int        `db:"forwarded_accountinfo_id" json:"forwarded_accountinfo_id,omitempty"`
+	// the uploaded file of a File message, nil for files named in the content only
+	FileID   *gocql.UUID `db:"file_id" json:"file_id,omitempty"`
+	FileSize *int64      `db:"file_size" json:"file_size,omitempty"`
+	FileMime *string     `db:"file_mime" json:"file_mime,omitempty"`
+	// not stored with the message, aggregated from the message_reaction table when needed
+	Reactions []ReactionSummary `db:"-" json:"reactions,omitempty"`
+	// not stored with the message, loaded from the poll tables for Poll messages
+	Poll *Poll `db:"-" json:"poll,omitempty"`
 }
 
-type MessagePOST struct {
+func (m *Message) Key() *MessageKey {
+	return &MessageKey{GroupID: m.GroupID, TimeCreated: m.TimeCreated, AccountinfoID: m.AccountinfoID}
+}
+
+// ReplyTo returns the key of the parent message, or nil if the message is not a reply.
+func (m *Message) ReplyTo() *MessageKey {
+	if m.ReplyToTimeCreated == nil || m.ReplyToAccountinfoID == nil {
+		return nil
+	}
+	return &MessageKey{GroupID: m.GroupID, TimeCreated: *m.ReplyToTimeCreated, AccountinfoID: *m.ReplyToAccountinfoID}
+}
+
+// ForwardedFrom returns the key of the original message, or nil if the message was not forwarded.
+func (m *Message) ForwardedFrom() *MessageKey {
+	if m.ForwardedGroupID == nil || m.ForwardedTimeCreated == nil || m.ForwardedAccountinfoID == nil {
+		return nil
+	}
+	return &MessageKey{GroupID: *m.ForwardedGroupID, TimeCreated: *m.ForwardedTimeCreated, AccountinfoID: *m.ForwardedAccountinfoID}
+}
+
+// MessageKey identifies a message.
+type MessageKey struct {
 	GroupID       gocql.UUID `json:"group_id"`
+	TimeCreated   time.Time  `json:"time_created"`
 	AccountinfoID int        `json:"accountinfo_id"`
-	Content       string     `json:"content"`
-	Type          string     `json:"type"`
+}
+
+// Reaction is a reaction of an account to a message.
+type Reaction struct {
+	GroupID              gocql.UUID `db:"group_id" json:"group_id"`
+	MessageTimeCreated   time.Time  `db:"message_time_created" json:"message_time_created"`
+	MessageAccountinfoID int        `db:"message_accountinfo_id" json:"message_accountinfo_id"`
+	Reaction             string     `db:"reaction" json:"reaction"`
+	AccountinfoID        int        `db:"accountinfo_id" json:"accountinfo_id"`
+	TimeCreated          time.Time  `db:"time_created" json:"time_created"`
+}
+
+// Poll holds the options of a Poll message, whose content is the question.
+type Poll struct {
+	GroupID              gocql.UUID `db:"group_id" json:"-"`
+	MessageTimeCreated   time.Time  `db:"message_time_created" json:"-"`
+	MessageAccountinfoID int        `db:"message_accountinfo_id" json:"-"`
+	Options              []string   `db:"options" json:"options"`
+	MultipleChoice       bool       `db:"multiple_choice" json:"multiple_choice"`
+	TimeClosed           *time.Time `db:"time_closed" json:"time_closed,omitempty"` // no vote is accepted after it
+	// not stored with the poll, tallied from the poll_vote table
+	Votes  []int `db:"-" json:"votes"`  // number of votes of each option
+	Voters int   `db:"-" json:"voters"` // number of accounts which voted
+}
+
+// IsClosed tells whether the poll stopped accepting votes.
+func (p *Poll) IsClosed() bool {
+	return p.TimeClosed != nil && !time.Now().Before(*p.TimeClosed)
+}
+
+// PollVote is the vote of an account for one or several options of a poll.
+type PollVote struct {
+	GroupID              gocql.UUID `db:"group_id" json:"group_id"`
+	MessageTimeCreated   time.Time  `db:"message_time_created" json:"message_time_created"`
+	MessageAccountinfoID int        `db:"message_accountinfo_id" json:"message_accountinfo_id"`
+	AccountinfoID        int        `db:"accountinfo_id" json:"accountinfo_id"`
+	Choices              []int      `db:"choices" json:"choices"` // indexes of the chosen options
+	TimeCreated          time.Time  `db:"time_created" json:"time_created"`
+}
+
+// MessagePin is a message pinned to its group by a participant.
+type MessagePin struct {
+	GroupID              gocql.UUID `db:"group_id" json:"group_id"`
+	MessageTimeCreated   time.Time  `db:"message_time_created" json:"message_time_created"`
+	MessageAccountinfoID int        `db:"message_accountinfo_id" json:"message_accountinfo_id"`
+	AccountinfoID        int        `db:"accountinfo_id" json:"accountinfo_id"`
+	TimeCreated          time.Time  `db:"time_created" json:"time_created"`
+}
+
+// ReactionSummary aggregates the reactions of the same kind to a message.
+type ReactionSummary struct {
+	Reaction       string `json:"reaction"`
+	Count          int    `json:"count"`
+	AccountinfoIDs []int  `json:"accountinfo_ids"`
+}
+
+// MessageDelivery acknowledges that a message reached a client of an account.
+type MessageDelivery struct {
+	GroupID              gocql.UUID `db:"group_id" json:"group_id"`
+	MessageTimeCreated   time.Time  `db:"message_time_created" json:"message_time_created"`
+	MessageAccountinfoID int        `db:"message_accountinfo_id" json:"message_accountinfo_id"`
+	AccountinfoID        int        `db:"accountinfo_id" json:"accountinfo_id"`
+	TimeCreated          time.Time  `db:"time_created" json:"time_created"`
+}
+
+// ReadMarker keeps the creation time of the last message an account read in a group.
+type ReadMarker struct {
+	GroupID       gocql.UUID `db:"group_id" json:"group_id"`
+	AccountinfoID int        `db:"accountinfo_id" json:"accountinfo_id"`
+	TimeRead      time.Time  `db:"time_read" json:"time_read"`
+	TimeCreated   time.Time  `db:"time_created" json:"time_created"`
+}
+
+type MessagePOST struct {
+	GroupID         gocql.UUID   `json:"group_id"`
+	AccountinfoID   int          `json:"accountinfo_id"`
+	Content         string       `json:"content"`
+	Type            string       `json:"type"`
+	ClientMessageID *gocql.UUID  `json:"client_message_id"`
+	Cursor          string       `json:"cursor"`
+	Limit           int          `json:"limit"`
+	AccountinfoIDs  []int        `json:"accountinfo_ids"`
+	GroupIDs        []gocql.UUID `json:"group_ids"`
+	Target          *MessageKey  `json:"target"`
+	ReplyTo         *MessageKey  `json:"reply_to"`
+	MuteUntil       *time.Time   `json:"mute_until"`
+	ExpiresIn       int          `json:"expires_in"` // in seconds
+	Options         []string     `json:"options"`
+	MultipleChoice  bool         `json:"multiple_choice"`
+	ClosesAt        *time.Time   `json:"closes_at"`
+	Choices         []int        `json:"choices"`
+	SendAt          *time.Time   `json:"send_at"`
+	ScheduledID     *gocql.UUID  `json:"scheduled_id"`
+	UploadID        *gocql.UUID  `json:"upload_id"`
+	FileSize        int64        `json:"file_size"` // in bytes
+	FileMime        string       `json:"file_mime"`
+	Checksum        string       `json:"checksum"` // hex-encoded SHA-256
+	Offset          int64        `json:"offset"`
+	Chunk           []byte       `json:"chunk"` // base64-encoded in JSON
+}
+
+// FileUpload is a file being uploaded in chunks by an account, to be sent as a File message to a group.
+//
+// The chunks are stored as separate objects until the upload is committed.
+type FileUpload struct {
+	ID                 gocql.UUID `db:"id" json:"upload_id"` // also the id of the file once committed
+	AccountinfoID      int        `db:"accountinfo_id" json:"-"`
+	GroupID            gocql.UUID `db:"group_id" json:"group_id"`
+	Filename           string     `db:"filename" json:"filename"`
+	FileSize           int64      `db:"file_size" json:"file_size"`
+	FileMime           string     `db:"file_mime" json:"file_mime"`
+	Checksum           string     `db:"checksum" json:"checksum"`
+	ChunkSize          int        `db:"chunk_size" json:"chunk_size"`
+	Received           int64      `db:"received" json:"received"` // number of bytes received, the offset of the next chunk
+	Status             string     `db:"status" json:"status"`
+	MessageTimeCreated *time.Time `db:"message_time_created" json:"-"` // the File message, once committed
+	TimeClaimed        *time.Time `db:"time_claimed" json:"-"`         // when the commit of the upload started
+	TimeCreated        time.Time  `db:"time_created" json:"time_created"`
+}
+
+// FileReference tells that a File message points at an uploaded file. A forwarded File message shares the file of the
+// original message, so a file can only be removed once no message references it.
+type FileReference struct {
+	FileID        gocql.UUID `db:"file_id"`
+	GroupID       gocql.UUID `db:"group_id"`
+	TimeCreated   time.Time  `db:"time_created"`
+	AccountinfoID int        `db:"accountinfo_id"`
+}
+
+// UploadExpiry tells when the chunks of an upload can be removed, once the upload expired.
+//
+// Upload expiries are partitioned by the hour of TimeExpired (Bucket), so that the scheduler only reads the due ones.
+type UploadExpiry struct {
+	Bucket      time.Time  `db:"bucket"`
+	TimeExpired time.Time  `db:"time_expired"`
+	ID          gocql.UUID `db:"id"`
+	Parts       int64      `db:"parts"`
+}
+
+// ScheduledMessage is a message waiting to be sent at SendAt.
+//
+// Scheduled messages are partitioned by the hour of SendAt (Bucket), so that the scheduler only reads the due ones.
+type ScheduledMessage struct {
+	Bucket          time.Time  `db:"bucket" json:"-"`
+	SendAt          time.Time  `db:"send_at" json:"send_at"`
+	ID              gocql.UUID `db:"id" json:"id"`
+	AccountinfoID   int        `db:"accountinfo_id" json:"-"`
+	AccountinfoName string     `db:"accountinfo_name" json:"-"`
+	GroupID         gocql.UUID `db:"group_id" json:"group_id"`
+	Data            string     `db:"data" json:"-"` // the MessagePOST of the message, as JSON
+	Status          string     `db:"status" json:"status"`
+	TimeClaimed     *time.Time `db:"time_claimed" json:"-"` // when an instance of the scheduler started sending it
+	TimeCreated     time.Time  `db:"time_created" json:"time_created"`
+	// decoded from Data when sent to the client
+	Message *MessagePOST `db:"-" json:"data,omitempty"`
+}
+
+// MessageExpiry tells that an ephemeral message expires at TimeExpired, so that its online participants can be told.
+//
+// Expiries are partitioned by the hour of TimeExpired (Bucket), so that the schedulers only read the recent ones.
+type MessageExpiry struct {
+	Bucket        time.Time   `db:"bucket"`
+	TimeExpired   time.Time   `db:"time_expired"`
+	GroupID       gocql.UUID  `db:"group_id"`
+	TimeCreated   time.Time   `db:"time_created"`
+	AccountinfoID int         `db:"accountinfo_id"`
+	FileID        *gocql.UUID `db:"file_id"` // of File messages, removed with the message if no other message references it
+}
+
+// MessageDedupe maps a client-generated message ID to the message it created, so that retries are not stored twice.
+type MessageDedupe struct {
+	AccountinfoID   int        `db:"accountinfo_id"`
+	ClientMessageID gocql.UUID `db:"client_message_id"`
+	GroupID         gocql.UUID `db:"group_id"`
+	TimeCreated     time.Time  `db:"time_created"`
+	// the scheduled message, if the message was sent with a send_at
+	ScheduledID *gocql.UUID `db:"scheduled_id"`
 }
 
 type Notification struct {
@@ -117,6 +514,8 @@ type Notification struct {
 	GroupID             gocql.UUID `db:"group_id" json:"group_id"`
 	AccountinfoIDSender int        `db:"accountinfo_id_sender" json:"accountinfo_id_sender"`
 	Content             string     `db:"content" json:"content"`
+	// the notifications of an ephemeral message expire with it
+	TimeExpired *time.Time `db:"-" json:"time_expired,omitempty"`
 }
 
 type NotificationSeen struct {
@@ -125,3 +524,28 @@ type NotificationSeen struct {
 	GroupID       gocql.UUID `db:"group_id" json:"group_id"`
 	TimeCreated   time.Time  `db:"time_created" json:"time_created"`
 }
+
+// UnreadCount is the number of unseen notifications of an account, per group and notification type.
+//
+// Counters cannot be set, so a reset moves to a new counter (Epoch) instead of subtracting the current value.
+type UnreadCount struct {
+	AccountinfoID int        `db:"accountinfo_id" json:"-"`
+	GroupID       gocql.UUID `db:"group_id" json:"group_id"`
+	Type          string     `db:"type" json:"type"`
+	Epoch         int        `db:"epoch" json:"-"` // number of resets, each one starts a new counter
+	Count         int64      `db:"count" json:"count"`
+}
+
+// UnreadExpiry tells that an unread count was incremented for an ephemeral notification, which expires at TimeExpired,
+// so that the count can be decremented when it expires.
+//
+// Unread expiries are partitioned by the hour of TimeExpired (Bucket), so that the scheduler only reads the due ones.
+type UnreadExpiry struct {
+	Bucket        time.Time  `db:"bucket"`
+	TimeExpired   time.Time  `db:"time_expired"`
+	AccountinfoID int        `db:"accountinfo_id"`
+	GroupID       gocql.UUID `db:"group_id"`
+	Type          string     `db:"type"`
+	Epoch         int        `db:"epoch"`
+	TimeCreated   time.Time  `db:"time_created"` // of the notification
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/db"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/db/dbmodels"
+	"github.com/scylladb/gocqlx/v2/qb"
+	"time"
+)
+
+// messageExpiryRetention is how long an expiry is kept after the message expired, for slow schedulers to catch up.
+const messageExpiryRetention = time.Hour
+
+type IMessageExpiryHandler interface {
+	AddMessageExpiry(message *dbmodels.Message) error
+	GetMessageExpiries(bucket time.Time, after time.Time, until time.Time) ([]dbmodels.MessageExpiry, error)
+	RemoveMessageExpiry(message *dbmodels.Message) error
+}
+
+type MessageExpiryHandler struct {
+	db *db.ScyllaDB
+}
+
+func NewMessageExpiryHandler(db *db.ScyllaDB) *MessageExpiryHandler {
+	return &MessageExpiryHandler{
+		db: db,
+	}
+}
+
+func newMessageExpiry(message *dbmodels.Message) *dbmodels.MessageExpiry {
+	return &dbmodels.MessageExpiry{
+		Bucket:        message.TimeExpired.Truncate(time.Hour),
+		TimeExpired:   *message.TimeExpired,
+		GroupID:       message.GroupID,
+		TimeCreated:   message.TimeCreated,
+		AccountinfoID: message.AccountinfoID,
+		FileID:        message.FileID,
+	}
+}
+
+// AddMessageExpiry stores the expiry of an ephemeral message.
+func (h MessageExpiryHandler) AddMessageExpiry(message *dbmodels.Message) error {
+	stmt, names := h.db.Tables.MessageExpiryTable.InsertBuilder().TTL(ttlUntil(message.TimeExpired.Add(messageExpiryRetention))).ToCql()
+	err := h.db.Session.Query(stmt, names).BindStruct(newMessageExpiry(message)).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while inserting MessageExpiry", err.Error())
+		return err
+	}
+	return nil
+}
+
+// GetMessageExpiries returns the expiries of a bucket which are due after the given time, until the other.
+func (h MessageExpiryHandler) GetMessageExpiries(bucket time.Time, after time.Time, until time.Time) ([]dbmodels.MessageExpiry, error) {
+	var expiries []dbmodels.MessageExpiry
+	stmt, names := h.db.Tables.MessageExpiryTable.SelectBuilder().Where(qb.GtNamed("time_expired", "after"), qb.LtOrEqNamed("time_expired", "until")).ToCql()
+	err := h.db.Session.Query(stmt, names).BindMap(qb.M{"bucket": bucket, "after": after, "until": until}).SelectRelease(&expiries)
+	if err != nil {
+		fmt.Println("An error occurred while getting message expiries", err.Error())
+		return nil, err
+	}
+	return expiries, nil
+}
+
+// RemoveMessageExpiry removes the expiry of a message, when the message is deleted before it expires.
+func (h MessageExpiryHandler) RemoveMessageExpiry(message *dbmodels.Message) error {
+	err := h.db.Session.Query(h.db.Tables.MessageExpiryTable.Delete()).BindStruct(newMessageExpiry(message)).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while deleting MessageExpiry", err.Error())
+		return err
+	}
+	return nil
+}
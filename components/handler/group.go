@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gocql/gocql"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/db"
@@ -9,6 +10,8 @@ import (
 
 type IGroupHandler interface {
 	GetGroupByID(groupID gocql.UUID) (*dbmodels.Group, error)
+	GetGroupSetting(groupID gocql.UUID) (*dbmodels.GroupSetting, error)
+	SetGroupSetting(setting *dbmodels.GroupSetting) error
 }
 
 type GroupHandler struct {
@@ -30,3 +33,26 @@ func (h GroupHandler) GetGroupByID(groupID gocql.UUID) (*dbmodels.Group, error)
 	}
 	return &group, nil
 }
+
+// GetGroupSetting returns the settings of a group, or nil if they were never set.
+func (h GroupHandler) GetGroupSetting(groupID gocql.UUID) (*dbmodels.GroupSetting, error) {
+	setting := dbmodels.GroupSetting{GroupID: groupID}
+	err := h.db.Session.Query(h.db.Tables.GroupSettingTable.Get()).BindStruct(setting).GetRelease(&setting)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		fmt.Println("An error occurred while getting group setting", err.Error())
+		return nil, err
+	}
+	return &setting, nil
+}
+
+func (h GroupHandler) SetGroupSetting(setting *dbmodels.GroupSetting) error {
+	err := h.db.Session.Query(h.db.Tables.GroupSettingTable.Insert()).BindStruct(setting).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while inserting GroupSetting", err.Error())
+		return err
+	}
+	return nil
+}
@@ -1,12 +1,29 @@
 package handler
 
 import (
+	"errors"
+	"fmt"
+	"github.com/gocql/gocql"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/db"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/db/dbmodels"
+	conf "github.com/khanhnguyen02311/EchoChat-WS/configurations"
+	"github.com/scylladb/gocqlx/v2/qb"
+	"time"
 )
 
+// clientMessageIDPendingTTL is how long a client message ID stays reserved while its message is being stored.
+const clientMessageIDPendingTTL = time.Minute
+
 type IMessageHandler interface {
 	AddNewMessage(message *dbmodels.Message) error
+	GetMessage(groupID gocql.UUID, timeCreated time.Time, accountinfoID int) (*dbmodels.Message, error)
+	GetMessagesFromGroup(groupID gocql.UUID, pageState []byte, pageSize int) ([]dbmodels.Message, []byte, error)
+	UpdateMessage(message *dbmodels.Message) error
+	AddReply(message *dbmodels.Message) error
+	GetRepliesFromMessage(parent *dbmodels.MessageKey, pageState []byte, pageSize int) ([]dbmodels.Message, []byte, error)
+	ReserveClientMessageID(dedupe *dbmodels.MessageDedupe) (*dbmodels.MessageDedupe, bool, error)
+	ConfirmClientMessageID(dedupe *dbmodels.MessageDedupe) error
+	RemoveClientMessageID(dedupe *dbmodels.MessageDedupe) error
 }
 
 type MessageHandler struct {
@@ -19,13 +36,161 @@ func NewMessageHandler(db *db.ScyllaDB) *MessageHandler {
 	}
 }
 
+// AddNewMessage stores a message in both message tables at once.
 func (h MessageHandler) AddNewMessage(message *dbmodels.Message) error {
-	err := h.db.Session.Query(h.db.Tables.MessageByGroupTable.Insert()).BindStruct(message).ExecRelease()
+	stmtByGroup, namesByGroup := h.db.Tables.MessageByGroupTable.Insert()
+	stmtByAccount, namesByAccount := h.db.Tables.MessageByAccountTable.Insert()
+	// ephemeral messages are removed by Scylla when they expire
+	if message.TimeExpired != nil {
+		ttl := ttlUntil(*message.TimeExpired)
+		stmtByGroup, namesByGroup = h.db.Tables.MessageByGroupTable.InsertBuilder().TTL(ttl).ToCql()
+		stmtByAccount, namesByAccount = h.db.Tables.MessageByAccountTable.InsertBuilder().TTL(ttl).ToCql()
+	}
+	// both tables share the column names, the message binds both statements
+	stmt, names := qb.Batch().AddStmt(stmtByGroup, namesByGroup).AddStmt(stmtByAccount, namesByAccount).ToCql()
+	err := h.db.Session.Query(stmt, names).BindStruct(message).ExecRelease()
 	if err != nil {
+		fmt.Println("An error occurred while inserting Message", err.Error())
 		return err
 	}
-	err = h.db.Session.Query(h.db.Tables.MessageByAccountTable.Insert()).BindStruct(message).ExecRelease()
+	return nil
+}
+
+// ttlUntil returns the TTL of a row expiring at the given time, in whole seconds and at least one.
+func ttlUntil(expiry time.Time) time.Duration {
+	ttl := time.Until(expiry).Truncate(time.Second) + time.Second
+	if ttl < time.Second {
+		return time.Second
+	}
+	return ttl
+}
+
+func (h MessageHandler) GetMessage(groupID gocql.UUID, timeCreated time.Time, accountinfoID int) (*dbmodels.Message, error) {
+	message := dbmodels.Message{GroupID: groupID, TimeCreated: timeCreated, AccountinfoID: accountinfoID}
+	err := h.db.Session.Query(h.db.Tables.MessageByGroupTable.Get()).BindStruct(message).GetRelease(&message)
+	if err != nil {
+		fmt.Println("An error occurred while getting message", err.Error())
+		return nil, err
+	}
+	return &message, nil
+}
+
+// GetMessagesFromGroup returns a page of messages of a group, newest first, and the paging state of the next page.
+func (h MessageHandler) GetMessagesFromGroup(groupID gocql.UUID, pageState []byte, pageSize int) ([]dbmodels.Message, []byte, error) {
+	var messages []dbmodels.Message
+	stmt, names := h.db.Tables.MessageByGroupTable.SelectBuilder().OrderBy("time_created", qb.DESC).ToCql()
+	iter := h.db.Session.Query(stmt, names).Bind(groupID).PageState(pageState).PageSize(pageSize).Iter()
+	nextPageState := iter.PageState()
+	if err := iter.Select(&messages); err != nil {
+		fmt.Println("An error occurred while getting messages", err.Error())
+		return nil, nil, err
+	}
+	return messages, nextPageState, nil
+}
+
+// UpdateMessage saves the content, edit time, deleted marker and mentions of a message in both message tables at once.
+func (h MessageHandler) UpdateMessage(message *dbmodels.Message) error {
+	// the updated cells of an ephemeral message must expire with the rest of the row
+	using := ""
+	if message.TimeExpired != nil {
+		using = fmt.Sprintf(" USING TTL %d", int(ttlUntil(*message.TimeExpired).Seconds()))
+	}
+	batch := h.db.Session.Session.NewBatch(gocql.LoggedBatch)
+	batch.Query("UPDATE message_by_group"+using+" SET content = ?, time_edited = ?, deleted = ?, mentions = ?, mention_all = ? WHERE group_id = ? AND time_created = ? AND accountinfo_id = ?",
+		message.Content, message.TimeEdited, message.Deleted, message.Mentions, message.MentionAll, message.GroupID, message.TimeCreated, message.AccountinfoID)
+	batch.Query("UPDATE message_by_account"+using+" SET content = ?, time_edited = ?, deleted = ?, mentions = ?, mention_all = ? WHERE accountinfo_id = ? AND time_created = ? AND group_id = ?",
+		message.Content, message.TimeEdited, message.Deleted, message.Mentions, message.MentionAll, message.AccountinfoID, message.TimeCreated, message.GroupID)
+	err := h.db.Session.Session.ExecuteBatch(batch)
+	if err != nil {
+		fmt.Println("An error occurred while updating message", err.Error())
+		return err
+	}
+	return nil
+}
+
+// AddReply adds a reply message to the thread of its parent message.
+func (h MessageHandler) AddReply(message *dbmodels.Message) error {
+	stmt, names := h.db.Tables.MessageReplyTable.Insert()
+	if message.TimeExpired != nil {
+		stmt, names = h.db.Tables.MessageReplyTable.InsertBuilder().TTL(ttlUntil(*message.TimeExpired)).ToCql()
+	}
+	err := h.db.Session.Query(stmt, names).BindStruct(message).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while inserting reply", err.Error())
+		return err
+	}
+	return nil
+}
+
+// GetRepliesFromMessage returns a page of replies to a message, oldest first, and the paging state of the next page.
+func (h MessageHandler) GetRepliesFromMessage(parent *dbmodels.MessageKey, pageState []byte, pageSize int) ([]dbmodels.Message, []byte, error) {
+	var replyKeys []dbmodels.Message
+	iter := h.db.Session.Query(h.db.Tables.MessageReplyTable.Select()).BindMap(map[string]interface{}{
+		"group_id":                parent.GroupID,
+		"reply_to_time_created":   parent.TimeCreated,
+		"reply_to_accountinfo_id": parent.AccountinfoID,
+	}).PageState(pageState).PageSize(pageSize).Iter()
+	nextPageState := iter.PageState()
+	if err := iter.Select(&replyKeys); err != nil {
+		fmt.Println("An error occurred while getting replies", err.Error())
+		return nil, nil, err
+	}
+	// the thread only keeps the keys, so that edits and deletions do not need to update it
+	replies := make([]dbmodels.Message, 0, len(replyKeys))
+	for _, key := range replyKeys {
+		reply, err := h.GetMessage(key.GroupID, key.TimeCreated, key.AccountinfoID)
+		if err == gocql.ErrNotFound {
+			// the reply expired, its key is about to expire too
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		replies = append(replies, *reply)
+	}
+	return replies, nextPageState, nil
+}
+
+// ReserveClientMessageID records the client message ID of a new message, for clientMessageIDPendingTTL until
+// ConfirmClientMessageID is called, so that a reservation left by a crash does not block the retries for long.
+//
+// It returns true if the ID was not used before. Otherwise, it returns false and the reservation of the original message.
+func (h MessageHandler) ReserveClientMessageID(dedupe *dbmodels.MessageDedupe) (*dbmodels.MessageDedupe, bool, error) {
+	stmt, names := h.db.Tables.MessageDedupeTable.InsertBuilder().Unique().TTL(clientMessageIDPendingTTL).ToCql()
+	original := dbmodels.MessageDedupe{}
+	applied, err := h.db.Session.Query(stmt, names).BindStruct(dedupe).GetCASRelease(&original)
+	if err != nil {
+		fmt.Println("An error occurred while reserving client message ID", err.Error())
+		return nil, false, err
+	}
+	if applied {
+		return nil, true, nil
+	}
+	return &original, false, nil
+}
+
+// ConfirmClientMessageID keeps a reserved client message ID for MESSAGE_DEDUPE_TTL, once its message is stored.
+func (h MessageHandler) ConfirmClientMessageID(dedupe *dbmodels.MessageDedupe) error {
+	var currentTimeCreated time.Time
+	applied, err := h.db.Session.Session.Query(fmt.Sprintf("UPDATE message_dedupe USING TTL %d SET group_id = ?, time_created = ?, scheduled_id = ? "+
+		"WHERE accountinfo_id = ? AND client_message_id = ? IF time_created = ?", int(conf.MESSAGE_DEDUPE_TTL.Seconds())),
+		dedupe.GroupID, dedupe.TimeCreated, dedupe.ScheduledID, dedupe.AccountinfoID, dedupe.ClientMessageID, dedupe.TimeCreated).ScanCAS(&currentTimeCreated)
+	if err != nil {
+		fmt.Println("An error occurred while confirming client message ID", err.Error())
+		return err
+	}
+	if !applied {
+		// the reservation expired before the message was stored
+		return errors.New("client message ID reservation lost")
+	}
+	return nil
+}
+
+// RemoveClientMessageID releases a reserved client message ID, so that the message can be retried after a failure.
+func (h MessageHandler) RemoveClientMessageID(dedupe *dbmodels.MessageDedupe) error {
+	err := h.db.Session.Query(h.db.Tables.MessageDedupeTable.Delete()).BindStruct(dedupe).ExecRelease()
 	if err != nil {
+		fmt.Println("An error occurred while removing client message ID", err.Error())
 		return err
 	}
 	return nil
@@ -1,14 +1,30 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
+	"github.com/gocql/gocql"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/db"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/db/dbmodels"
+	conf "github.com/khanhnguyen02311/EchoChat-WS/configurations"
+	"github.com/scylladb/gocqlx/v2/qb"
+	"golang.org/x/exp/slices"
+	"time"
 )
 
+// notificationSeenBatchSize keeps the batches of AddAllNotificationsSeen below the batch size thresholds.
+const notificationSeenBatchSize = 50
+
 type INotificationHandler interface {
 	AddNotification(notification *dbmodels.Notification) error
 	AddNotificationSeen(notificationSeen *dbmodels.NotificationSeen) error
+	AddAllNotificationsSeen(accountinfoID int, groupIDs []gocql.UUID, notificationTypes []string, timeSeen time.Time) error
+	GetNotifications(accountinfoID int, notificationType string, pageState []byte, pageSize int) ([]dbmodels.Notification, []byte, error)
+	GetUnreadCount(accountinfoID int, groupID gocql.UUID, notificationType string) (*dbmodels.UnreadCount, error)
+	GetAllUnreadCounts(accountinfoID int) ([]dbmodels.UnreadCount, error)
+	ResetUnreadCount(accountinfoID int, groupID gocql.UUID, notificationType string) error
+	GetExpiredUnreadCounts(bucket time.Time, until time.Time) ([]dbmodels.UnreadExpiry, error)
+	RemoveExpiredUnreadCount(expiry *dbmodels.UnreadExpiry) (bool, error)
 }
 
 type NotificationHandler struct {
@@ -22,22 +38,197 @@ func NewNotificationHandler(db *db.ScyllaDB) *NotificationHandler {
 }
 
 func (h NotificationHandler) AddNotification(notification *dbmodels.Notification) error {
-	err := h.db.Session.Query(h.db.Tables.NotificationTable.Insert()).BindStruct(notification).ExecRelease()
+	err := h.insertNotification(notification)
 	if err != nil {
 		fmt.Println("An error occurred while inserting Notification", err.Error())
 		return err
 	}
+	h.incrementUnreadCount(notification)
 	return nil
 }
 
 func (h NotificationHandler) AddMultipleNotifications(accountinfoIDs []int, notification *dbmodels.Notification) {
 	for _, id := range accountinfoIDs {
 		notification.AccountinfoID = id
-		err := h.db.Session.Query(h.db.Tables.NotificationTable.Insert()).BindStruct(notification).ExecRelease()
+		err := h.insertNotification(notification)
 		if err != nil {
 			fmt.Println("An error occurred while inserting Notification", err.Error())
+			continue
 		}
+		h.incrementUnreadCount(notification)
+	}
+}
+
+func (h NotificationHandler) insertNotification(notification *dbmodels.Notification) error {
+	stmt, names := h.db.Tables.NotificationTable.Insert()
+	if notification.TimeExpired != nil {
+		stmt, names = h.db.Tables.NotificationTable.InsertBuilder().TTL(ttlUntil(*notification.TimeExpired)).ToCql()
+	}
+	return h.db.Session.Query(stmt, names).BindStruct(notification).ExecRelease()
+}
+
+func (h NotificationHandler) incrementUnreadCount(notification *dbmodels.Notification) {
+	epoch, err := h.getUnreadEpoch(notification.AccountinfoID, notification.GroupID, notification.Type)
+	if err != nil {
+		return
+	}
+	err = h.db.Session.Session.Query("UPDATE unread_count SET count = count + 1 WHERE accountinfo_id = ? AND group_id = ? AND type = ? AND epoch = ?",
+		notification.AccountinfoID, notification.GroupID, notification.Type, epoch).Exec()
+	if err != nil {
+		fmt.Println("An error occurred while incrementing UnreadCount", err.Error())
+		return
+	}
+	if notification.TimeExpired != nil {
+		h.addUnreadExpiry(notification, epoch)
+	}
+}
+
+// addUnreadExpiry stores the expiry of an ephemeral notification, so that the scheduler decrements the unread count it
+// incremented once the notification expired (see RemoveExpiredUnreadCount).
+func (h NotificationHandler) addUnreadExpiry(notification *dbmodels.Notification, epoch int) {
+	expiry := dbmodels.UnreadExpiry{
+		Bucket:        notification.TimeExpired.Truncate(time.Hour),
+		TimeExpired:   *notification.TimeExpired,
+		AccountinfoID: notification.AccountinfoID,
+		GroupID:       notification.GroupID,
+		Type:          notification.Type,
+		Epoch:         epoch,
+		TimeCreated:   notification.TimeCreated,
+	}
+	// the expiry outlives the notification, for the schedulers started within SCHEDULER_LOOKBACK to find it
+	stmt, names := h.db.Tables.UnreadExpiryTable.InsertBuilder().TTL(ttlUntil(expiry.TimeExpired.Add(conf.SCHEDULER_LOOKBACK))).ToCql()
+	err := h.db.Session.Query(stmt, names).BindStruct(expiry).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while inserting UnreadExpiry", err.Error())
+	}
+}
+
+// getUnreadEpoch returns the number of resets of an unread count, zero if it was never reset.
+func (h NotificationHandler) getUnreadEpoch(accountinfoID int, groupID gocql.UUID, notificationType string) (int, error) {
+	unreadCount := dbmodels.UnreadCount{AccountinfoID: accountinfoID, GroupID: groupID, Type: notificationType}
+	err := h.db.Session.Query(h.db.Tables.UnreadEpochTable.Get()).BindStruct(unreadCount).GetRelease(&unreadCount)
+	if err != nil && !errors.Is(err, gocql.ErrNotFound) {
+		fmt.Println("An error occurred while getting UnreadEpoch", err.Error())
+		return 0, err
+	}
+	return unreadCount.Epoch, nil
+}
+
+// GetUnreadCount returns the unread count of an account for a group and notification type, zero if there is none.
+func (h NotificationHandler) GetUnreadCount(accountinfoID int, groupID gocql.UUID, notificationType string) (*dbmodels.UnreadCount, error) {
+	epoch, err := h.getUnreadEpoch(accountinfoID, groupID, notificationType)
+	if err != nil {
+		return nil, err
+	}
+	unreadCount := dbmodels.UnreadCount{AccountinfoID: accountinfoID, GroupID: groupID, Type: notificationType, Epoch: epoch}
+	err = h.db.Session.Query(h.db.Tables.UnreadCountTable.Get()).BindStruct(unreadCount).GetRelease(&unreadCount)
+	if err != nil && !errors.Is(err, gocql.ErrNotFound) {
+		fmt.Println("An error occurred while getting UnreadCount", err.Error())
+		return nil, err
+	}
+	return &unreadCount, nil
+}
+
+// GetAllUnreadCounts returns the current unread counts of an account, skipping the counters of previous epochs.
+func (h NotificationHandler) GetAllUnreadCounts(accountinfoID int) ([]dbmodels.UnreadCount, error) {
+	var epochs []dbmodels.UnreadCount
+	err := h.db.Session.Query(h.db.Tables.UnreadEpochTable.Select()).BindStruct(dbmodels.UnreadCount{AccountinfoID: accountinfoID}).SelectRelease(&epochs)
+	if err != nil {
+		fmt.Println("An error occurred while getting UnreadEpochs", err.Error())
+		return nil, err
+	}
+	var unreadCounts []dbmodels.UnreadCount
+	err = h.db.Session.Query(h.db.Tables.UnreadCountTable.Select()).BindStruct(dbmodels.UnreadCount{AccountinfoID: accountinfoID}).SelectRelease(&unreadCounts)
+	if err != nil {
+		fmt.Println("An error occurred while getting UnreadCounts", err.Error())
+		return nil, err
+	}
+	return slices.DeleteFunc(unreadCounts, func(unreadCount dbmodels.UnreadCount) bool {
+		i := slices.IndexFunc(epochs, func(epoch dbmodels.UnreadCount) bool {
+			return epoch.GroupID == unreadCount.GroupID && epoch.Type == unreadCount.Type
+		})
+		return (i < 0 && unreadCount.Epoch != 0) || (i >= 0 && epochs[i].Epoch != unreadCount.Epoch)
+	}), nil
+}
+
+// ResetUnreadCount sets an unread count back to zero, by moving to the next epoch with a lightweight transaction.
+// Concurrent resets (e.g. from several devices) move it once, and notifications counted meanwhile are never
+// subtracted twice.
+func (h NotificationHandler) ResetUnreadCount(accountinfoID int, groupID gocql.UUID, notificationType string) error {
+	unreadCount, err := h.GetUnreadCount(accountinfoID, groupID, notificationType)
+	if err != nil {
+		return err
 	}
+	if unreadCount.Count == 0 {
+		return nil
+	}
+	var applied bool
+	if unreadCount.Epoch == 0 {
+		applied, err = h.db.Session.Session.Query("INSERT INTO unread_epoch (accountinfo_id, group_id, type, epoch) VALUES (?, ?, ?, ?) IF NOT EXISTS",
+			accountinfoID, groupID, notificationType, 1).MapScanCAS(map[string]interface{}{})
+	} else {
+		var currentEpoch int
+		applied, err = h.db.Session.Session.Query("UPDATE unread_epoch SET epoch = ? WHERE accountinfo_id = ? AND group_id = ? AND type = ? IF epoch = ?",
+			unreadCount.Epoch+1, accountinfoID, groupID, notificationType, unreadCount.Epoch).ScanCAS(&currentEpoch)
+	}
+	if err != nil {
+		fmt.Println("An error occurred while resetting UnreadCount", err.Error())
+		return err
+	}
+	if !applied {
+		// another connection reset it meanwhile
+		return nil
+	}
+	// the previous counter is not read anymore
+	err = h.db.Session.Session.Query("DELETE FROM unread_count WHERE accountinfo_id = ? AND group_id = ? AND type = ? AND epoch = ?",
+		accountinfoID, groupID, notificationType, unreadCount.Epoch).Exec()
+	if err != nil {
+		fmt.Println("An error occurred while deleting UnreadCount", err.Error())
+	}
+	return nil
+}
+
+// GetExpiredUnreadCounts returns the unread expiries of a bucket which are due until the given time.
+func (h NotificationHandler) GetExpiredUnreadCounts(bucket time.Time, until time.Time) ([]dbmodels.UnreadExpiry, error) {
+	var expiries []dbmodels.UnreadExpiry
+	stmt, names := h.db.Tables.UnreadExpiryTable.SelectBuilder().Where(qb.LtOrEqNamed("time_expired", "until")).ToCql()
+	err := h.db.Session.Query(stmt, names).BindMap(qb.M{"bucket": bucket, "until": until}).SelectRelease(&expiries)
+	if err != nil {
+		fmt.Println("An error occurred while getting expired unread counts", err.Error())
+		return nil, err
+	}
+	return expiries, nil
+}
+
+// RemoveExpiredUnreadCount removes an unread expiry, and decrements the unread count it belongs to, unless the count
+// was reset since. It returns true if the count was decremented.
+//
+// The expiry is removed with a lightweight transaction, so that only one scheduler decrements the count.
+func (h NotificationHandler) RemoveExpiredUnreadCount(expiry *dbmodels.UnreadExpiry) (bool, error) {
+	applied, err := h.db.Session.Session.Query("DELETE FROM unread_expiry WHERE bucket = ? AND time_expired = ? AND accountinfo_id = ? "+
+		"AND group_id = ? AND type = ? AND epoch = ? AND time_created = ? IF EXISTS", expiry.Bucket, expiry.TimeExpired,
+		expiry.AccountinfoID, expiry.GroupID, expiry.Type, expiry.Epoch, expiry.TimeCreated).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		fmt.Println("An error occurred while deleting UnreadExpiry", err.Error())
+		return false, err
+	}
+	if !applied {
+		// another scheduler removed it meanwhile
+		return false, nil
+	}
+	epoch, err := h.getUnreadEpoch(expiry.AccountinfoID, expiry.GroupID, expiry.Type)
+	if err != nil || epoch != expiry.Epoch {
+		// a reset already counted the notification out; a reset between this check and the decrement only touches
+		// the previous counter, which is not read anymore
+		return false, err
+	}
+	err = h.db.Session.Session.Query("UPDATE unread_count SET count = count - 1 WHERE accountinfo_id = ? AND group_id = ? AND type = ? AND epoch = ?",
+		expiry.AccountinfoID, expiry.GroupID, expiry.Type, expiry.Epoch).Exec()
+	if err != nil {
+		fmt.Println("An error occurred while decrementing UnreadCount", err.Error())
+		return false, err
+	}
+	return true, nil
 }
 
 func (h NotificationHandler) AddNotificationSeen(notificationSeen *dbmodels.NotificationSeen) error {
@@ -48,3 +239,51 @@ func (h NotificationHandler) AddNotificationSeen(notificationSeen *dbmodels.Noti
 	}
 	return nil
 }
+
+// AddAllNotificationsSeen marks every notification type of every given group as seen, in batches of
+// notificationSeenBatchSize rows.
+func (h NotificationHandler) AddAllNotificationsSeen(accountinfoID int, groupIDs []gocql.UUID, notificationTypes []string, timeSeen time.Time) error {
+	// all rows belong to the partition of the account, so the batches do not need to be logged
+	batch := h.db.Session.Session.NewBatch(gocql.UnloggedBatch)
+	for _, groupID := range groupIDs {
+		for _, notificationType := range notificationTypes {
+			batch.Query("INSERT INTO notification_seen (accountinfo_id, type, group_id, time_created) VALUES (?, ?, ?, ?)",
+				accountinfoID, notificationType, groupID, timeSeen)
+			if batch.Size() == notificationSeenBatchSize {
+				if err := h.executeNotificationSeenBatch(batch); err != nil {
+					return err
+				}
+				batch = h.db.Session.Session.NewBatch(gocql.UnloggedBatch)
+			}
+		}
+	}
+	if batch.Size() == 0 {
+		return nil
+	}
+	return h.executeNotificationSeenBatch(batch)
+}
+
+func (h NotificationHandler) executeNotificationSeenBatch(batch *gocql.Batch) error {
+	err := h.db.Session.Session.ExecuteBatch(batch)
+	if err != nil {
+		fmt.Println("An error occurred while inserting NotificationSeens", err.Error())
+		return err
+	}
+	return nil
+}
+
+// GetNotifications returns a page of notifications of an account and type, newest first, and the paging state of the
+// next page.
+func (h NotificationHandler) GetNotifications(accountinfoID int, notificationType string, pageState []byte, pageSize int) ([]dbmodels.Notification, []byte, error) {
+	var notifications []dbmodels.Notification
+	stmt, names := qb.Select(h.db.Tables.NotificationTable.Name()).Where(qb.Eq("accountinfo_id"), qb.Eq("type")).
+		OrderBy("type", qb.DESC).OrderBy("time_created", qb.DESC).ToCql()
+	iter := h.db.Session.Query(stmt, names).BindStruct(dbmodels.Notification{AccountinfoID: accountinfoID, Type: notificationType}).
+		PageState(pageState).PageSize(pageSize).Iter()
+	nextPageState := iter.PageState()
+	if err := iter.Select(&notifications); err != nil {
+		fmt.Println("An error occurred while getting notifications", err.Error())
+		return nil, nil, err
+	}
+	return notifications, nextPageState, nil
+}
@@ -5,11 +5,18 @@ import (
 	"github.com/gocql/gocql"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/db"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/db/dbmodels"
+	"time"
 )
 
 type IParticipantHandler interface {
 	CheckJoinedParticipant(accountinfoID int, groupID gocql.UUID) (*dbmodels.Participant, error)
 	GetAllParticipantIDsFromGroup(groupID gocql.UUID) ([]int, error)
+	GetAllGroupIDsFromAccount(accountinfoID int) ([]gocql.UUID, error)
+	GetAllParticipantsFromGroup(groupID gocql.UUID) ([]dbmodels.Participant, error)
+	SetParticipantNotify(participant *dbmodels.Participant, notify bool) error
+	MuteParticipant(mute *dbmodels.ParticipantMute) error
+	UnmuteParticipant(groupID gocql.UUID, accountinfoID int) error
+	GetAllMutedIDsFromGroup(groupID gocql.UUID) ([]int, error)
 }
 
 type ParticipantHandler struct {
@@ -47,3 +54,88 @@ func (h ParticipantHandler) GetAllParticipantIDsFromGroup(groupID gocql.UUID) ([
 	}
 	return accountinfoIDs, nil
 }
+
+func (h ParticipantHandler) GetAllGroupIDsFromAccount(accountinfoID int) ([]gocql.UUID, error) {
+	var ID gocql.UUID
+	var groupIDs []gocql.UUID
+	iter := h.db.Session.Session.Query("SELECT group_id FROM participant_by_account WHERE accountinfo_id = ?", accountinfoID).Iter()
+	for iter.Scan(&ID) {
+		groupIDs = append(groupIDs, ID)
+	}
+	if err := iter.Close(); err != nil {
+		fmt.Println("An error occurred while getting all groups", err.Error())
+		return nil, err
+	}
+	return groupIDs, nil
+}
+
+// GetAllParticipantsFromGroup returns the participants of a group, with their account id and notify flag only.
+func (h ParticipantHandler) GetAllParticipantsFromGroup(groupID gocql.UUID) ([]dbmodels.Participant, error) {
+	participant := dbmodels.Participant{GroupID: groupID}
+	var participants []dbmodels.Participant
+	iter := h.db.Session.Session.Query("SELECT accountinfo_id, notify FROM participant_by_group WHERE group_id = ?", groupID).Iter()
+	for iter.Scan(&participant.AccountinfoID, &participant.Notify) {
+		participants = append(participants, participant)
+	}
+	if err := iter.Close(); err != nil {
+		fmt.Println("An error occurred while getting all participants", err.Error())
+		return nil, err
+	}
+	return participants, nil
+}
+
+// SetParticipantNotify turns the notifications of a group on or off for a participant, in both participant tables.
+func (h ParticipantHandler) SetParticipantNotify(participant *dbmodels.Participant, notify bool) error {
+	batch := h.db.Session.Session.NewBatch(gocql.LoggedBatch)
+	batch.Query("UPDATE participant_by_group SET notify = ? WHERE group_id = ? AND time_created = ? AND accountinfo_id = ?",
+		notify, participant.GroupID, participant.TimeCreated, participant.AccountinfoID)
+	batch.Query("UPDATE participant_by_account SET notify = ? WHERE accountinfo_id = ? AND group_id = ? AND time_created = ?",
+		notify, participant.AccountinfoID, participant.GroupID, participant.TimeCreated)
+	err := h.db.Session.Session.ExecuteBatch(batch)
+	if err != nil {
+		fmt.Println("An error occurred while updating participant", err.Error())
+		return err
+	}
+	participant.Notify = notify
+	return nil
+}
+
+// MuteParticipant mutes a group for a participant until mute.MuteUntil, which must be in the future.
+func (h ParticipantHandler) MuteParticipant(mute *dbmodels.ParticipantMute) error {
+	ttl := int(time.Until(mute.MuteUntil).Seconds()) + 1
+	err := h.db.Session.Session.Query("INSERT INTO participant_mute (group_id, accountinfo_id, mute_until, time_created) VALUES (?, ?, ?, ?) USING TTL ?",
+		mute.GroupID, mute.AccountinfoID, mute.MuteUntil, mute.TimeCreated, ttl).Exec()
+	if err != nil {
+		fmt.Println("An error occurred while inserting ParticipantMute", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (h ParticipantHandler) UnmuteParticipant(groupID gocql.UUID, accountinfoID int) error {
+	err := h.db.Session.Query(h.db.Tables.ParticipantMuteTable.Delete()).BindStruct(dbmodels.ParticipantMute{GroupID: groupID, AccountinfoID: accountinfoID}).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while deleting ParticipantMute", err.Error())
+		return err
+	}
+	return nil
+}
+
+// GetAllMutedIDsFromGroup returns the participants of a group who muted it for now.
+func (h ParticipantHandler) GetAllMutedIDsFromGroup(groupID gocql.UUID) ([]int, error) {
+	var mutes []dbmodels.ParticipantMute
+	err := h.db.Session.Query(h.db.Tables.ParticipantMuteTable.Select()).BindStruct(dbmodels.ParticipantMute{GroupID: groupID}).SelectRelease(&mutes)
+	if err != nil {
+		fmt.Println("An error occurred while getting muted participants", err.Error())
+		return nil, err
+	}
+	accountinfoIDs := make([]int, 0, len(mutes))
+	now := time.Now()
+	for _, mute := range mutes {
+		// rows expire with a precision of one second
+		if mute.MuteUntil.After(now) {
+			accountinfoIDs = append(accountinfoIDs, mute.AccountinfoID)
+		}
+	}
+	return accountinfoIDs, nil
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/gocql/gocql"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/db"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/db/dbmodels"
+)
+
+type IPinHandler interface {
+	AddPin(pin *dbmodels.MessagePin, message *dbmodels.Message) error
+	GetPin(pin *dbmodels.MessagePin) (*dbmodels.MessagePin, error)
+	RemovePin(pin *dbmodels.MessagePin) error
+	GetAllPinsFromGroup(groupID gocql.UUID) ([]dbmodels.MessagePin, error)
+}
+
+type PinHandler struct {
+	db *db.ScyllaDB
+}
+
+func NewPinHandler(db *db.ScyllaDB) *PinHandler {
+	return &PinHandler{
+		db: db,
+	}
+}
+
+// AddPin pins a message to its group. The pin of an ephemeral message expires with it.
+func (h PinHandler) AddPin(pin *dbmodels.MessagePin, message *dbmodels.Message) error {
+	stmt, names := h.db.Tables.MessagePinTable.Insert()
+	if message.TimeExpired != nil {
+		stmt, names = h.db.Tables.MessagePinTable.InsertBuilder().TTL(ttlUntil(*message.TimeExpired)).ToCql()
+	}
+	err := h.db.Session.Query(stmt, names).BindStruct(pin).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while inserting MessagePin", err.Error())
+		return err
+	}
+	return nil
+}
+
+// GetPin returns the pin of the message of the given pin, or nil if the message is not pinned.
+func (h PinHandler) GetPin(pin *dbmodels.MessagePin) (*dbmodels.MessagePin, error) {
+	current := *pin
+	err := h.db.Session.Query(h.db.Tables.MessagePinTable.Get()).BindStruct(pin).GetRelease(&current)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		fmt.Println("An error occurred while getting pin", err.Error())
+		return nil, err
+	}
+	return &current, nil
+}
+
+func (h PinHandler) RemovePin(pin *dbmodels.MessagePin) error {
+	err := h.db.Session.Query(h.db.Tables.MessagePinTable.Delete()).BindStruct(pin).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while deleting MessagePin", err.Error())
+		return err
+	}
+	return nil
+}
+
+// GetAllPinsFromGroup returns the pins of a group, sorted by the creation time of the pinned messages.
+func (h PinHandler) GetAllPinsFromGroup(groupID gocql.UUID) ([]dbmodels.MessagePin, error) {
+	var pins []dbmodels.MessagePin
+	err := h.db.Session.Query(h.db.Tables.MessagePinTable.Select()).BindStruct(dbmodels.MessagePin{GroupID: groupID}).SelectRelease(&pins)
+	if err != nil {
+		fmt.Println("An error occurred while getting pins", err.Error())
+		return nil, err
+	}
+	return pins, nil
+}
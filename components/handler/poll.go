@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/db"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/db/dbmodels"
+)
+
+type IPollHandler interface {
+	AddPoll(poll *dbmodels.Poll, message *dbmodels.Message) error
+	GetPoll(key *dbmodels.MessageKey) (*dbmodels.Poll, error)
+	AddVote(vote *dbmodels.PollVote, message *dbmodels.Message) (bool, error)
+}
+
+type PollHandler struct {
+	db *db.ScyllaDB
+}
+
+func NewPollHandler(db *db.ScyllaDB) *PollHandler {
+	return &PollHandler{
+		db: db,
+	}
+}
+
+// AddPoll stores the options of a Poll message. The poll of an ephemeral message expires with it.
+func (h PollHandler) AddPoll(poll *dbmodels.Poll, message *dbmodels.Message) error {
+	stmt, names := h.db.Tables.PollTable.Insert()
+	if message.TimeExpired != nil {
+		stmt, names = h.db.Tables.PollTable.InsertBuilder().TTL(ttlUntil(*message.TimeExpired)).ToCql()
+	}
+	err := h.db.Session.Query(stmt, names).BindStruct(poll).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while inserting Poll", err.Error())
+		return err
+	}
+	return nil
+}
+
+// GetPoll returns the poll of a message, with its votes tallied.
+func (h PollHandler) GetPoll(key *dbmodels.MessageKey) (*dbmodels.Poll, error) {
+	poll := dbmodels.Poll{GroupID: key.GroupID, MessageTimeCreated: key.TimeCreated, MessageAccountinfoID: key.AccountinfoID}
+	err := h.db.Session.Query(h.db.Tables.PollTable.Get()).BindStruct(poll).GetRelease(&poll)
+	if err != nil {
+		fmt.Println("An error occurred while getting poll", err.Error())
+		return nil, err
+	}
+	var votes []dbmodels.PollVote
+	err = h.db.Session.Query(h.db.Tables.PollVoteTable.Select()).BindStruct(dbmodels.PollVote{
+		GroupID:              key.GroupID,
+		MessageTimeCreated:   key.TimeCreated,
+		MessageAccountinfoID: key.AccountinfoID,
+	}).SelectRelease(&votes)
+	if err != nil {
+		fmt.Println("An error occurred while getting poll votes", err.Error())
+		return nil, err
+	}
+	poll.Votes = make([]int, len(poll.Options))
+	poll.Voters = len(votes)
+	for _, vote := range votes {
+		for _, choice := range vote.Choices {
+			if choice >= 0 && choice < len(poll.Votes) {
+				poll.Votes[choice]++
+			}
+		}
+	}
+	return &poll, nil
+}
+
+// AddVote records the vote of an account, unless it already voted for this poll.
+//
+// It returns false if the account already voted. The check is a lightweight transaction, so it holds across instances.
+func (h PollHandler) AddVote(vote *dbmodels.PollVote, message *dbmodels.Message) (bool, error) {
+	builder := h.db.Tables.PollVoteTable.InsertBuilder().Unique()
+	if message.TimeExpired != nil {
+		builder = builder.TTL(ttlUntil(*message.TimeExpired))
+	}
+	stmt, names := builder.ToCql()
+	applied, err := h.db.Session.Query(stmt, names).BindStruct(vote).GetCASRelease(&dbmodels.PollVote{})
+	if err != nil {
+		fmt.Println("An error occurred while inserting PollVote", err.Error())
+		return false, err
+	}
+	return applied, nil
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/db"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/db/dbmodels"
+)
+
+type IReactionHandler interface {
+	AddReaction(reaction *dbmodels.Reaction, message *dbmodels.Message) error
+	RemoveReaction(reaction *dbmodels.Reaction) error
+	GetReactionSummary(key *dbmodels.MessageKey) ([]dbmodels.ReactionSummary, error)
+}
+
+type ReactionHandler struct {
+	db *db.ScyllaDB
+}
+
+func NewReactionHandler(db *db.ScyllaDB) *ReactionHandler {
+	return &ReactionHandler{
+		db: db,
+	}
+}
+
+// AddReaction adds a reaction to a message. The reaction to an ephemeral message expires with it.
+func (h ReactionHandler) AddReaction(reaction *dbmodels.Reaction, message *dbmodels.Message) error {
+	stmt, names := h.db.Tables.MessageReactionTable.Insert()
+	if message.TimeExpired != nil {
+		stmt, names = h.db.Tables.MessageReactionTable.InsertBuilder().TTL(ttlUntil(*message.TimeExpired)).ToCql()
+	}
+	err := h.db.Session.Query(stmt, names).BindStruct(reaction).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while inserting Reaction", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (h ReactionHandler) RemoveReaction(reaction *dbmodels.Reaction) error {
+	err := h.db.Session.Query(h.db.Tables.MessageReactionTable.Delete()).BindStruct(reaction).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while deleting Reaction", err.Error())
+		return err
+	}
+	return nil
+}
+
+// GetReactionSummary returns the reactions to a message, grouped by reaction in alphabetical order.
+func (h ReactionHandler) GetReactionSummary(key *dbmodels.MessageKey) ([]dbmodels.ReactionSummary, error) {
+	var reactions []dbmodels.Reaction
+	err := h.db.Session.Query(h.db.Tables.MessageReactionTable.Select()).BindStruct(dbmodels.Reaction{
+		GroupID:              key.GroupID,
+		MessageTimeCreated:   key.TimeCreated,
+		MessageAccountinfoID: key.AccountinfoID,
+	}).SelectRelease(&reactions)
+	if err != nil {
+		fmt.Println("An error occurred while getting reactions", err.Error())
+		return nil, err
+	}
+	// rows are sorted by reaction, so the same reactions are next to each other
+	var summaries []dbmodels.ReactionSummary
+	for _, reaction := range reactions {
+		if len(summaries) == 0 || summaries[len(summaries)-1].Reaction != reaction.Reaction {
+			summaries = append(summaries, dbmodels.ReactionSummary{Reaction: reaction.Reaction})
+		}
+		summary := &summaries[len(summaries)-1]
+		summary.Count++
+		summary.AccountinfoIDs = append(summary.AccountinfoIDs, reaction.AccountinfoID)
+	}
+	return summaries, nil
+}
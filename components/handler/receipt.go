@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gocql/gocql"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/db"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/db/dbmodels"
+)
+
+type IReceiptHandler interface {
+	AddDelivery(delivery *dbmodels.MessageDelivery, message *dbmodels.Message) error
+	CountDeliveries(key *dbmodels.MessageKey) (int, error)
+	GetReadMarker(groupID gocql.UUID, accountinfoID int) (*dbmodels.ReadMarker, error)
+	GetAllReadMarkersFromGroup(groupID gocql.UUID) ([]dbmodels.ReadMarker, error)
+	SetReadMarker(marker *dbmodels.ReadMarker) error
+}
+
+type ReceiptHandler struct {
+	db *db.ScyllaDB
+}
+
+func NewReceiptHandler(db *db.ScyllaDB) *ReceiptHandler {
+	return &ReceiptHandler{
+		db: db,
+	}
+}
+
+// AddDelivery records the delivery of a message to an account. The delivery of an ephemeral message expires with it.
+func (h ReceiptHandler) AddDelivery(delivery *dbmodels.MessageDelivery, message *dbmodels.Message) error {
+	stmt, names := h.db.Tables.MessageDeliveryTable.Insert()
+	if message.TimeExpired != nil {
+		stmt, names = h.db.Tables.MessageDeliveryTable.InsertBuilder().TTL(ttlUntil(*message.TimeExpired)).ToCql()
+	}
+	err := h.db.Session.Query(stmt, names).BindStruct(delivery).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while inserting MessageDelivery", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (h ReceiptHandler) CountDeliveries(key *dbmodels.MessageKey) (int, error) {
+	var count int
+	err := h.db.Session.Session.Query("SELECT COUNT(*) FROM message_delivery WHERE group_id = ? AND message_time_created = ? AND message_accountinfo_id = ?",
+		key.GroupID, key.TimeCreated, key.AccountinfoID).Scan(&count)
+	if err != nil {
+		fmt.Println("An error occurred while counting deliveries", err.Error())
+		return 0, err
+	}
+	return count, nil
+}
+
+// GetReadMarker returns the read marker of an account in a group, or nil if the account never read the group.
+func (h ReceiptHandler) GetReadMarker(groupID gocql.UUID, accountinfoID int) (*dbmodels.ReadMarker, error) {
+	marker := dbmodels.ReadMarker{GroupID: groupID, AccountinfoID: accountinfoID}
+	err := h.db.Session.Query(h.db.Tables.ReadMarkerTable.Get()).BindStruct(marker).GetRelease(&marker)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		fmt.Println("An error occurred while getting read marker", err.Error())
+		return nil, err
+	}
+	return &marker, nil
+}
+
+func (h ReceiptHandler) GetAllReadMarkersFromGroup(groupID gocql.UUID) ([]dbmodels.ReadMarker, error) {
+	var markers []dbmodels.ReadMarker
+	err := h.db.Session.Query(h.db.Tables.ReadMarkerTable.Select()).BindStruct(dbmodels.ReadMarker{GroupID: groupID}).SelectRelease(&markers)
+	if err != nil {
+		fmt.Println("An error occurred while getting read markers", err.Error())
+		return nil, err
+	}
+	return markers, nil
+}
+
+func (h ReceiptHandler) SetReadMarker(marker *dbmodels.ReadMarker) error {
+	err := h.db.Session.Query(h.db.Tables.ReadMarkerTable.Insert()).BindStruct(marker).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while inserting ReadMarker", err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/gocql/gocql"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/db"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/db/dbmodels"
+	"github.com/scylladb/gocqlx/v2/qb"
+	"time"
+)
+
+// scheduledMessageRetention is how long a scheduled message is kept after its send time, for troubleshooting.
+const scheduledMessageRetention = 7 * 24 * time.Hour
+
+type IScheduledMessageHandler interface {
+	AddScheduledMessage(scheduled *dbmodels.ScheduledMessage) error
+	GetScheduledMessage(sendAt time.Time, id gocql.UUID) (*dbmodels.ScheduledMessage, error)
+	GetDueScheduledMessages(bucket time.Time, until time.Time) ([]dbmodels.ScheduledMessage, error)
+	GetAllScheduledMessagesFromAccount(accountinfoID int) ([]dbmodels.ScheduledMessage, error)
+	SetScheduledMessageStatus(scheduled *dbmodels.ScheduledMessage, status string) (bool, error)
+	RemoveScheduledMessageFromAccount(scheduled *dbmodels.ScheduledMessage) error
+}
+
+type ScheduledMessageHandler struct {
+	db *db.ScyllaDB
+}
+
+func NewScheduledMessageHandler(db *db.ScyllaDB) *ScheduledMessageHandler {
+	return &ScheduledMessageHandler{
+		db: db,
+	}
+}
+
+// AddScheduledMessage stores a scheduled message in both scheduled message tables at once.
+func (h ScheduledMessageHandler) AddScheduledMessage(scheduled *dbmodels.ScheduledMessage) error {
+	scheduled.Bucket = scheduled.SendAt.Truncate(time.Hour)
+	// both rows expire together, the account table must not point at a missing message
+	ttl := int(ttlUntil(scheduled.SendAt.Add(scheduledMessageRetention)).Seconds())
+	batch := h.db.Session.Session.NewBatch(gocql.LoggedBatch)
+	batch.Query(fmt.Sprintf("INSERT INTO scheduled_message_by_time (bucket, send_at, id, accountinfo_id, accountinfo_name, group_id, data, status, time_created) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) USING TTL %d", ttl),
+		scheduled.Bucket, scheduled.SendAt, scheduled.ID, scheduled.AccountinfoID, scheduled.AccountinfoName, scheduled.GroupID, scheduled.Data,
+		scheduled.Status, scheduled.TimeCreated)
+	batch.Query(fmt.Sprintf("INSERT INTO scheduled_message_by_account (accountinfo_id, send_at, id, bucket, group_id) VALUES (?, ?, ?, ?, ?) USING TTL %d", ttl),
+		scheduled.AccountinfoID, scheduled.SendAt, scheduled.ID, scheduled.Bucket, scheduled.GroupID)
+	err := h.db.Session.Session.ExecuteBatch(batch)
+	if err != nil {
+		fmt.Println("An error occurred while inserting ScheduledMessage", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (h ScheduledMessageHandler) GetScheduledMessage(sendAt time.Time, id gocql.UUID) (*dbmodels.ScheduledMessage, error) {
+	scheduled := dbmodels.ScheduledMessage{Bucket: sendAt.Truncate(time.Hour), SendAt: sendAt, ID: id}
+	err := h.db.Session.Query(h.db.Tables.ScheduledMessageByTimeTable.Get()).BindStruct(scheduled).GetRelease(&scheduled)
+	if err != nil {
+		fmt.Println("An error occurred while getting scheduled message", err.Error())
+		return nil, err
+	}
+	return &scheduled, nil
+}
+
+// GetDueScheduledMessages returns the scheduled messages of a bucket which are due at the given time, whatever their status.
+func (h ScheduledMessageHandler) GetDueScheduledMessages(bucket time.Time, until time.Time) ([]dbmodels.ScheduledMessage, error) {
+	var scheduled []dbmodels.ScheduledMessage
+	stmt, names := h.db.Tables.ScheduledMessageByTimeTable.SelectBuilder().Where(qb.LtOrEq("send_at")).ToCql()
+	err := h.db.Session.Query(stmt, names).BindStruct(dbmodels.ScheduledMessage{Bucket: bucket, SendAt: until}).SelectRelease(&scheduled)
+	if err != nil {
+		fmt.Println("An error occurred while getting due scheduled messages", err.Error())
+		return nil, err
+	}
+	return scheduled, nil
+}
+
+// GetAllScheduledMessagesFromAccount returns the scheduled messages of an account which were not sent or canceled yet.
+func (h ScheduledMessageHandler) GetAllScheduledMessagesFromAccount(accountinfoID int) ([]dbmodels.ScheduledMessage, error) {
+	var keys []dbmodels.ScheduledMessage
+	err := h.db.Session.Query(h.db.Tables.ScheduledMessageByAccountTable.Select()).BindStruct(dbmodels.ScheduledMessage{AccountinfoID: accountinfoID}).SelectRelease(&keys)
+	if err != nil {
+		fmt.Println("An error occurred while getting scheduled messages", err.Error())
+		return nil, err
+	}
+	// the account table only keeps the keys, the status lives with the message
+	scheduled := make([]dbmodels.ScheduledMessage, 0, len(keys))
+	for _, key := range keys {
+		s, err := h.GetScheduledMessage(key.SendAt, key.ID)
+		if err == gocql.ErrNotFound {
+			// the message expired, its key is about to expire too
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scheduled = append(scheduled, *s)
+	}
+	return scheduled, nil
+}
+
+// SetScheduledMessageStatus changes the status of a scheduled message, if nobody changed it since it was read.
+//
+// The check is a lightweight transaction on the status and claim time, so that only one scheduler instance can claim a
+// message, and a canceled message is never sent. Claiming (status "Sending") also sets the claim time.
+func (h ScheduledMessageHandler) SetScheduledMessageStatus(scheduled *dbmodels.ScheduledMessage, status string) (bool, error) {
+	timeClaimed := scheduled.TimeClaimed
+	if status == dbmodels.DBScheduledStatus[1] {
+		now := time.Now().UTC()
+		timeClaimed = &now
+	}
+	var currentStatus string
+	var currentTimeClaimed *time.Time
+	// the updated cells must expire with the rest of the row
+	ttl := int(ttlUntil(scheduled.SendAt.Add(scheduledMessageRetention)).Seconds())
+	applied, err := h.db.Session.Session.Query(fmt.Sprintf("UPDATE scheduled_message_by_time USING TTL %d SET status = ?, time_claimed = ? "+
+		"WHERE bucket = ? AND send_at = ? AND id = ? IF status = ? AND time_claimed = ?", ttl), status, timeClaimed, scheduled.Bucket, scheduled.SendAt, scheduled.ID, scheduled.Status, scheduled.TimeClaimed).
+		ScanCAS(&currentStatus, &currentTimeClaimed)
+	if err != nil {
+		fmt.Println("An error occurred while updating scheduled message", err.Error())
+		return false, err
+	}
+	if !applied {
+		return false, nil
+	}
+	scheduled.Status = status
+	scheduled.TimeClaimed = timeClaimed
+	return true, nil
+}
+
+// RemoveScheduledMessageFromAccount removes a sent or canceled message from the scheduled messages of its account.
+func (h ScheduledMessageHandler) RemoveScheduledMessageFromAccount(scheduled *dbmodels.ScheduledMessage) error {
+	err := h.db.Session.Query(h.db.Tables.ScheduledMessageByAccountTable.Delete()).BindStruct(scheduled).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while deleting ScheduledMessage", err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/gocql/gocql"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/db"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/db/dbmodels"
+	conf "github.com/khanhnguyen02311/EchoChat-WS/configurations"
+	"github.com/scylladb/gocqlx/v2/qb"
+	"time"
+)
+
+type IFileUploadHandler interface {
+	AddUpload(upload *dbmodels.FileUpload) error
+	GetUpload(id gocql.UUID) (*dbmodels.FileUpload, error)
+	SetUploadReceived(upload *dbmodels.FileUpload, received int64) (bool, error)
+	SetUploadStatus(upload *dbmodels.FileUpload, status string) (bool, error)
+	GetExpiredUploads(bucket time.Time, until time.Time) ([]dbmodels.UploadExpiry, error)
+	RemoveUploadExpiry(expiry *dbmodels.UploadExpiry) error
+	AddFileReference(message *dbmodels.Message) error
+	RemoveFileReference(fileID gocql.UUID, key *dbmodels.MessageKey) (bool, error)
+}
+
+type FileUploadHandler struct {
+	db *db.ScyllaDB
+}
+
+func NewFileUploadHandler(db *db.ScyllaDB) *FileUploadHandler {
+	return &FileUploadHandler{
+		db: db,
+	}
+}
+
+// uploadTTL returns the remaining TTL of an upload, so that updated cells expire with the rest of the row.
+func uploadTTL(upload *dbmodels.FileUpload) int {
+	return int(ttlUntil(upload.TimeCreated.Add(conf.UPLOAD_TTL)).Seconds())
+}
+
+// AddUpload stores a new upload, which expires after UPLOAD_TTL, together with its expiry, so that its chunks are
+// removed once it expired.
+func (h FileUploadHandler) AddUpload(upload *dbmodels.FileUpload) error {
+	timeExpired := upload.TimeCreated.Add(conf.UPLOAD_TTL)
+	expiry := dbmodels.UploadExpiry{
+		Bucket:      timeExpired.Truncate(time.Hour),
+		TimeExpired: timeExpired,
+		ID:          upload.ID,
+		Parts:       (upload.FileSize + int64(upload.ChunkSize) - 1) / int64(upload.ChunkSize),
+	}
+	batch := h.db.Session.Session.NewBatch(gocql.LoggedBatch)
+	batch.Query(fmt.Sprintf("INSERT INTO file_upload (id, accountinfo_id, group_id, filename, file_size, file_mime, checksum, chunk_size, received, "+
+		"status, time_created) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) USING TTL %d", uploadTTL(upload)),
+		upload.ID, upload.AccountinfoID, upload.GroupID, upload.Filename, upload.FileSize, upload.FileMime, upload.Checksum, upload.ChunkSize,
+		upload.Received, upload.Status, upload.TimeCreated)
+	// the expiry outlives the upload, for the schedulers started within SCHEDULER_LOOKBACK to find it
+	batch.Query(fmt.Sprintf("INSERT INTO upload_expiry (bucket, time_expired, id, parts) VALUES (?, ?, ?, ?) USING TTL %d",
+		int(ttlUntil(timeExpired.Add(conf.SCHEDULER_LOOKBACK)).Seconds())),
+		expiry.Bucket, expiry.TimeExpired, expiry.ID, expiry.Parts)
+	err := h.db.Session.Session.ExecuteBatch(batch)
+	if err != nil {
+		fmt.Println("An error occurred while inserting FileUpload", err.Error())
+		return err
+	}
+	return nil
+}
+
+// GetUpload returns an upload, or nil if it does not exist or expired.
+func (h FileUploadHandler) GetUpload(id gocql.UUID) (*dbmodels.FileUpload, error) {
+	upload := dbmodels.FileUpload{ID: id}
+	err := h.db.Session.Query(h.db.Tables.FileUploadTable.Get()).BindStruct(upload).GetRelease(&upload)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		fmt.Println("An error occurred while getting upload", err.Error())
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// SetUploadReceived moves the offset of an upload after a stored chunk, if no other chunk was stored since it was read.
+func (h FileUploadHandler) SetUploadReceived(upload *dbmodels.FileUpload, received int64) (bool, error) {
+	var currentReceived int64
+	applied, err := h.db.Session.Session.Query(fmt.Sprintf("UPDATE file_upload USING TTL %d SET received = ? WHERE id = ? IF received = ?", uploadTTL(upload)),
+		received, upload.ID, upload.Received).ScanCAS(&currentReceived)
+	if err != nil {
+		fmt.Println("An error occurred while updating upload", err.Error())
+		return false, err
+	}
+	if !applied {
+		upload.Received = currentReceived
+		return false, nil
+	}
+	upload.Received = received
+	return true, nil
+}
+
+// SetUploadStatus changes the status of an upload, if nobody changed it since it was read, so that an upload is only
+// committed once. A committed upload also keeps the creation time of its File message, and an upload being committed
+// the time of its claim.
+func (h FileUploadHandler) SetUploadStatus(upload *dbmodels.FileUpload, status string) (bool, error) {
+	timeClaimed := upload.TimeClaimed
+	if status == dbmodels.DBUploadStatus[1] {
+		now := time.Now().UTC()
+		timeClaimed = &now
+	}
+	var currentStatus string
+	var currentTimeClaimed *time.Time
+	applied, err := h.db.Session.Session.Query(fmt.Sprintf("UPDATE file_upload USING TTL %d SET status = ?, message_time_created = ?, time_claimed = ? "+
+		"WHERE id = ? IF status = ? AND time_claimed = ?", uploadTTL(upload)),
+		status, upload.MessageTimeCreated, timeClaimed, upload.ID, upload.Status, upload.TimeClaimed).ScanCAS(&currentStatus, &currentTimeClaimed)
+	if err != nil {
+		fmt.Println("An error occurred while updating upload", err.Error())
+		return false, err
+	}
+	if !applied {
+		return false, nil
+	}
+	upload.Status = status
+	upload.TimeClaimed = timeClaimed
+	return true, nil
+}
+
+// GetExpiredUploads returns the expiries of a bucket which are due at the given time.
+func (h FileUploadHandler) GetExpiredUploads(bucket time.Time, until time.Time) ([]dbmodels.UploadExpiry, error) {
+	var expiries []dbmodels.UploadExpiry
+	stmt, names := h.db.Tables.UploadExpiryTable.SelectBuilder().Where(qb.LtOrEqNamed("time_expired", "until")).ToCql()
+	err := h.db.Session.Query(stmt, names).BindMap(qb.M{"bucket": bucket, "until": until}).SelectRelease(&expiries)
+	if err != nil {
+		fmt.Println("An error occurred while getting expired uploads", err.Error())
+		return nil, err
+	}
+	return expiries, nil
+}
+
+// RemoveUploadExpiry removes the expiry of an upload, once its chunks are removed.
+func (h FileUploadHandler) RemoveUploadExpiry(expiry *dbmodels.UploadExpiry) error {
+	err := h.db.Session.Query(h.db.Tables.UploadExpiryTable.Delete()).BindStruct(expiry).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while deleting UploadExpiry", err.Error())
+		return err
+	}
+	return nil
+}
+
+// AddFileReference records that a File message points at its file. The reference of an ephemeral message expires with it.
+func (h FileUploadHandler) AddFileReference(message *dbmodels.Message) error {
+	stmt, names := h.db.Tables.FileReferenceTable.Insert()
+	if message.TimeExpired != nil {
+		stmt, names = h.db.Tables.FileReferenceTable.InsertBuilder().TTL(ttlUntil(*message.TimeExpired)).ToCql()
+	}
+	err := h.db.Session.Query(stmt, names).BindStruct(dbmodels.FileReference{
+		FileID:        *message.FileID,
+		GroupID:       message.GroupID,
+		TimeCreated:   message.TimeCreated,
+		AccountinfoID: message.AccountinfoID,
+	}).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while inserting FileReference", err.Error())
+		return err
+	}
+	return nil
+}
+
+// RemoveFileReference removes the reference of a message to a file, and tells whether other messages still reference
+// the file.
+func (h FileUploadHandler) RemoveFileReference(fileID gocql.UUID, key *dbmodels.MessageKey) (bool, error) {
+	reference := dbmodels.FileReference{FileID: fileID, GroupID: key.GroupID, TimeCreated: key.TimeCreated, AccountinfoID: key.AccountinfoID}
+	err := h.db.Session.Query(h.db.Tables.FileReferenceTable.Delete()).BindStruct(reference).ExecRelease()
+	if err != nil {
+		fmt.Println("An error occurred while deleting FileReference", err.Error())
+		return false, err
+	}
+	var references []dbmodels.FileReference
+	stmt, names := h.db.Tables.FileReferenceTable.SelectBuilder().Limit(1).ToCql()
+	err = h.db.Session.Query(stmt, names).BindStruct(reference).SelectRelease(&references)
+	if err != nil {
+		fmt.Println("An error occurred while getting FileReferences", err.Error())
+		return false, err
+	}
+	return len(references) > 0, nil
+}
@@ -1,54 +1,559 @@
 package connection
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/gocql/gocql"
 	"github.com/gorilla/websocket"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/db/dbmodels"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/manager/message"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/manager/session"
+	conf "github.com/khanhnguyen02311/EchoChat-WS/configurations"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/exp/slices"
+	"mime"
+	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SendQueuePolicyDropOldest = "drop-oldest"
+	SendQueuePolicyDropNewest = "drop-newest"
+	SendQueuePolicyDisconnect = "disconnect"
+)
+
+// readLimitOverhead is the room left in a frame for the JSON envelope and the other fields, besides an upload chunk.
+const readLimitOverhead = 64 << 10
+
+var (
+	ErrConnectionClosed = errors.New("connection closed")
+	ErrSendQueueFull    = errors.New("send queue full, message dropped")
+	ErrInboundQueueFull = errors.New("too many messages in progress, please slow down")
 )
 
 // WSConnection wraps a websocket connection.
 //
 // It provides methods for reading and writing JSON messages, and provides support handler for other use cases.
+// Outgoing messages are put in a bounded queue (WS_SEND_QUEUE_SIZE) and written by a dedicated writer goroutine,
+// so a slow client never blocks the senders. When the queue is full, WS_SEND_QUEUE_POLICY decides what happens.
+// Incoming messages are processed one at a time and in order by a processor goroutine, with at most
+// WS_INBOUND_QUEUE_SIZE messages waiting. The writer also keeps the connection alive with a heartbeat: a ping is sent every WS_PING_INTERVAL,
+// and the connection is considered dead if nothing (including pongs) is read within WS_PONG_WAIT, or if a ping cannot be
+// written within WS_WRITE_WAIT (see Reaped).
 type WSConnection struct {
-	Conn       *websocket.Conn
-	ClientID   int
-	ClientName string
-	mutex      sync.Mutex
-	//ActiveGroup *uuid.UUID
+	Conn             *websocket.Conn
+	ClientID         int
+	ClientName       string
+	Session          *session.Session
+	send             chan *message.OutputMessage
+	inbound          chan *message.InputMessage
+	sendQueueDepth   prometheus.Gauge
+	sendQueueDropped *prometheus.CounterVec
+	done             chan struct{}
+	closeOnce        sync.Once
+	closeRequest     chan []byte // close frame for the writer to send, see _requestClose
+	pingInterval     time.Duration
+	pongWait         time.Duration
+	reaped           atomic.Bool
+	// groups the connection is viewing, nil until the client declares them with group-focus
+	activeGroups      []gocql.UUID
+	activeGroupsMutex sync.RWMutex
+}
+
+func NewWSConnection(conn *websocket.Conn, clientID int, clientName string, sendQueueDepth prometheus.Gauge, sendQueueDropped *prometheus.CounterVec) *WSConnection {
+	c := &WSConnection{
+		Conn:             conn,
+		ClientID:         clientID,
+		ClientName:       clientName,
+		send:             make(chan *message.OutputMessage, conf.WS_SEND_QUEUE_SIZE),
+		inbound:          make(chan *message.InputMessage, conf.WS_INBOUND_QUEUE_SIZE),
+		sendQueueDepth:   sendQueueDepth,
+		sendQueueDropped: sendQueueDropped,
+		done:             make(chan struct{}),
+		closeRequest:     make(chan []byte, 1),
+		pingInterval:     conf.WS_PING_INTERVAL,
+		pongWait:         conf.WS_PONG_WAIT,
+	}
+	// a larger frame closes the connection before it is buffered; upload chunks are the largest fields, in base64
+	c.Conn.SetReadLimit(int64(base64.StdEncoding.EncodedLen(conf.UPLOAD_CHUNK_SIZE) + readLimitOverhead))
+	_ = c._extendReadDeadline()
+	c.Conn.SetPongHandler(func(string) error {
+		return c._extendReadDeadline()
+	})
+	return c
 }
 
-// TODO: add support for active group
+// _extendReadDeadline gives the peer another WS_PONG_WAIT to send something, a pong or a message.
+func (c *WSConnection) _extendReadDeadline() error {
+	return c.Conn.SetReadDeadline(time.Now().Add(c.pongWait))
+}
+
+// Reaped tells whether the writer closed the connection because a heartbeat ping could not be written in time. The
+// read loop then fails with a closed connection error instead of a timeout (see IsTimeoutError).
+func (c *WSConnection) Reaped() bool {
+	return c.reaped.Load()
+}
+
+// SetActiveGroups sets the groups the connection is viewing. Once set, even to an empty list, the connection only
+// receives the live events of these groups (see Wants).
+func (c *WSConnection) SetActiveGroups(groupIDs []gocql.UUID) {
+	c.activeGroupsMutex.Lock()
+	defer c.activeGroupsMutex.Unlock()
+	c.activeGroups = append(make([]gocql.UUID, 0, len(groupIDs)), groupIDs...)
+}
+
+// IsViewing tells whether the connection views one of the groups. A connection which never declared its groups views
+// all of them.
+func (c *WSConnection) IsViewing(groupIDs ...gocql.UUID) bool {
+	c.activeGroupsMutex.RLock()
+	defer c.activeGroupsMutex.RUnlock()
+	if c.activeGroups == nil {
+		return true
+	}
+	for _, groupID := range groupIDs {
+		if slices.Contains(c.activeGroups, groupID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wants tells whether an event should be delivered to the connection, depending on the groups it is viewing:
+// the timeline and typing events of a group only reach its viewers, while the group notifications only reach the
+// other connections.
+func (c *WSConnection) Wants(msg *message.OutputMessage) bool {
+	if groupID := msg.GroupID(); groupID != nil {
+		return c.IsViewing(*groupID)
+	}
+	if msg.Type == message.MsgTypeNotification && msg.Notification != nil && msg.Notification.Type == dbmodels.DBNotificationType[0] {
+		c.activeGroupsMutex.RLock()
+		defer c.activeGroupsMutex.RUnlock()
+		return !slices.Contains(c.activeGroups, msg.Notification.GroupID)
+	}
+	return true
+}
+
+// StartWriter starts the goroutine that drains the send queue and sends heartbeat pings until the connection is closed.
+func (c *WSConnection) StartWriter() {
+	go func() {
+		ticker := time.NewTicker(c.pingInterval)
+		defer ticker.Stop()
+		for {
+			// a requested close goes before the queued messages
+			select {
+			case frame := <-c.closeRequest:
+				c._writeClose(frame)
+				return
+			default:
+			}
+			select {
+			case <-c.done:
+				return
+			case frame := <-c.closeRequest:
+				c._writeClose(frame)
+				return
+			case msg := <-c.send:
+				c.sendQueueDepth.Dec()
+				_ = c.Conn.SetWriteDeadline(time.Now().Add(conf.WS_WRITE_WAIT))
+				if err := c.Conn.WriteJSON(msg); err != nil {
+					fmt.Printf("Error writing message to client %d: %s\n", c.ClientID, err.Error())
+					_ = c.Close()
+					return
+				}
+			case <-ticker.C:
+				err := c.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(conf.WS_WRITE_WAIT))
+				if err != nil {
+					// stop accepting messages, the read loop then fails and cleans the connection up
+					c.reaped.Store(true)
+					_ = c.Close()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// StartProcessor starts the goroutine that passes dispatched messages to process, in order, until the connection is closed.
+func (c *WSConnection) StartProcessor(process func(msg *message.InputMessage)) {
+	go func() {
+		for {
+			select {
+			case <-c.done:
+				return
+			case msg := <-c.inbound:
+				process(msg)
+			}
+		}
+	}()
+}
+
+// Dispatch queues a message for the processor goroutine. It fails instead of blocking when too many messages are waiting.
+func (c *WSConnection) Dispatch(msg *message.InputMessage) error {
+	select {
+	case c.inbound <- msg:
+		return nil
+	default:
+		return ErrInboundQueueFull
+	}
+}
+
+func (c *WSConnection) _drainSendQueue() {
+	for {
+		select {
+		case <-c.send:
+			c.sendQueueDepth.Dec()
+		default:
+			return
+		}
+	}
+}
+
+// Close stops the writer, drops the queued messages and closes the underlying connection. It is safe to call
+// multiple times.
+func (c *WSConnection) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c._drainSendQueue()
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// _requestClose asks the writer to send a close frame and close the connection. It never blocks, the writer may be
+// stuck on a slow peer.
+func (c *WSConnection) _requestClose(code int, reason string) {
+	select {
+	case c.closeRequest <- websocket.FormatCloseMessage(code, reason):
+	default: // already requested
+	}
+}
+
+func (c *WSConnection) _writeClose(frame []byte) {
+	_ = c.Conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(conf.WS_WRITE_WAIT))
+	_ = c.Close()
+}
+
+// CloseWithCode sends a close frame with the given code and reason before closing the connection.
+func (c *WSConnection) CloseWithCode(code int, reason string) error {
+	_ = c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(conf.WS_WRITE_WAIT))
+	return c.Close()
+}
 
 func (c *WSConnection) ReadJSONMessage() (*message.InputMessage, error) {
 	msg := &message.InputMessage{}
-	err := c.Conn.ReadJSON(&msg)
+	_, data, err := c.Conn.ReadMessage()
 	if err != nil {
 		//fmt.Printf("Error reading message from client %d: %s\n", c.ClientID, err.Error())
 		return nil, err
 	}
+	// any message from the client proves the connection is still alive
+	_ = c._extendReadDeadline()
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, &InvalidMessageError{Err: err}
+	}
 	// validate message contents
 	switch msg.Type {
 	case message.MsgTypeMessageNew:
-		if msg.Data == nil || !slices.Contains(dbmodels.DBMessageType[:2], msg.Data.Type) || msg.Data.Content == "" {
-			return nil, fmt.Errorf("invalid required fields for new message (group_id, content, type)")
+		if msg.Data == nil || !slices.Contains(dbmodels.DBMessageType[:3], msg.Data.Type) || msg.Data.Content == "" ||
+			msg.Data.ExpiresIn < 0 || msg.Data.ExpiresIn > message.ExpiresInMax {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for new message (group_id, content, type, expires_in up to %d)", message.ExpiresInMax)
+		}
+		if msg.Data.Type == dbmodels.DBMessageType[2] && !validPollOptions(msg.Data.Options) {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for new poll (2 to %d distinct options, up to %d bytes each)",
+				message.PollOptionMax, message.PollOptionMaxLength)
 		}
 		//fmt.Printf("Received message from client %d\n", c.ClientID)
 	case message.MsgTypeNotificationRead:
 		if msg.Data == nil || !slices.Contains(dbmodels.DBNotificationType, msg.Data.Type) {
-			return nil, fmt.Errorf("invalid required fields for marking read notification (group_id, type)")
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for marking read notification (group_id, type)")
 		}
 		//fmt.Printf("Received notification mark from client %d\n", c.ClientID)
+	case message.MsgTypeNotificationList:
+		// notifications are clustered by type, a list across types would come grouped by type instead of by time
+		if msg.Data == nil || !slices.Contains(dbmodels.DBNotificationType, msg.Data.Type) ||
+			msg.Data.Limit < 0 || msg.Data.Limit > message.PageSizeMax {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for notification list (type, limit up to %d)", message.PageSizeMax)
+		}
+		if msg.Data.Limit == 0 {
+			msg.Data.Limit = message.PageSizeDefault
+		}
+	case message.MsgTypeNotificationReadAll:
+		// no data needed
+	case message.MsgTypeMessageHistory:
+		if msg.Data == nil || msg.Data.Limit < 0 || msg.Data.Limit > message.PageSizeMax {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for message history (group_id, limit up to %d)", message.PageSizeMax)
+		}
+		if msg.Data.Limit == 0 {
+			msg.Data.Limit = message.PageSizeDefault
+		}
+	case message.MsgTypeMessageThread:
+		if msg.Data == nil || msg.Data.Target == nil || msg.Data.Limit < 0 || msg.Data.Limit > message.PageSizeMax {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for message thread (target, limit up to %d)", message.PageSizeMax)
+		}
+		if msg.Data.Limit == 0 {
+			msg.Data.Limit = message.PageSizeDefault
+		}
+	case message.MsgTypeMessageEdit:
+		if msg.Data == nil || msg.Data.Target == nil || msg.Data.Content == "" {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for editing message (target, content)")
+		}
+	case message.MsgTypeMessageDelete:
+		if msg.Data == nil || msg.Data.Target == nil {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for deleting message (target)")
+		}
+	case message.MsgTypeReactionAdd, message.MsgTypeReactionRemove:
+		if msg.Data == nil || msg.Data.Target == nil || !validReaction(msg.Data.Content) {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for reaction (target, content as a single emoji up to %d bytes)", message.ReactionMaxLength)
+		}
+	case message.MsgTypePollVote:
+		if msg.Data == nil || msg.Data.Target == nil || len(msg.Data.Choices) == 0 || len(msg.Data.Choices) > message.PollOptionMax {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for poll vote (target, choices)")
+		}
+	case message.MsgTypeMessageForward:
+		if msg.Data == nil || msg.Data.Target == nil || len(msg.Data.GroupIDs) == 0 || len(msg.Data.GroupIDs) > message.ForwardGroupMax {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for forwarding message (target, up to %d group_ids)", message.ForwardGroupMax)
+		}
+	case message.MsgTypeUploadBegin:
+		// an upload_id resumes an existing upload
+		if msg.Data == nil || (msg.Data.UploadID == nil && (msg.Data.Content == "" || msg.Data.FileSize <= 0 ||
+			msg.Data.FileSize > int64(conf.UPLOAD_MAX_SIZE) || !validChecksum(msg.Data.Checksum))) {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for upload begin (upload_id, or group_id, content, file_size up to %d bytes, checksum)",
+				conf.UPLOAD_MAX_SIZE)
+		}
+		if msg.Data.FileMime != "" {
+			if _, _, err := mime.ParseMediaType(msg.Data.FileMime); err != nil {
+				return nil, invalidMessageErrorf(msg.RequestID, "invalid file_mime for upload begin: %s", err.Error())
+			}
+		}
+	case message.MsgTypeUploadChunk:
+		if msg.Data == nil || msg.Data.UploadID == nil || msg.Data.Offset < 0 || len(msg.Data.Chunk) == 0 ||
+			len(msg.Data.Chunk) > conf.UPLOAD_CHUNK_SIZE || !validChecksum(msg.Data.Checksum) {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for upload chunk (upload_id, offset, chunk up to %d bytes, checksum)",
+				conf.UPLOAD_CHUNK_SIZE)
+		}
+	case message.MsgTypeUploadCommit:
+		if msg.Data == nil || msg.Data.UploadID == nil || msg.Data.ExpiresIn < 0 || msg.Data.ExpiresIn > message.ExpiresInMax {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for upload commit (upload_id, expires_in up to %d)", message.ExpiresInMax)
+		}
+	case message.MsgTypeScheduledList:
+		// no data needed
+	case message.MsgTypeScheduledCancel:
+		if msg.Data == nil || msg.Data.ScheduledID == nil || msg.Data.SendAt == nil {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for canceling scheduled message (scheduled_id, send_at)")
+		}
+	case message.MsgTypeMessagePin, message.MsgTypeMessageUnpin:
+		if msg.Data == nil || msg.Data.Target == nil {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for pin (target)")
+		}
+	case message.MsgTypePinsList:
+		if msg.Data == nil {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for pins list (group_id)")
+		}
+	case message.MsgTypeMessageDelivered, message.MsgTypeMessageRead:
+		if msg.Data == nil || msg.Data.Target == nil {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for read receipt (target)")
+		}
+	case message.MsgTypeTypingStart, message.MsgTypeTypingStop:
+		if msg.Data == nil {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for typing indicator (group_id)")
+		}
+	case message.MsgTypeGroupMute, message.MsgTypeGroupUnmute:
+		if msg.Data == nil {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for group mute (group_id)")
+		}
+	case message.MsgTypeGroupFocus:
+		if msg.Data == nil || len(msg.Data.GroupIDs) > message.FocusGroupMax {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for group focus (group_ids, up to %d)", message.FocusGroupMax)
+		}
+	case message.MsgTypeGroupRetention:
+		if msg.Data == nil || msg.Data.ExpiresIn < 0 || msg.Data.ExpiresIn > message.ExpiresInMax {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for group retention (group_id, expires_in up to %d)", message.ExpiresInMax)
+		}
+	case message.MsgTypePresenceQuery:
+		if msg.Data == nil || len(msg.Data.AccountinfoIDs) == 0 || len(msg.Data.AccountinfoIDs) > message.PageSizeMax {
+			return nil, invalidMessageErrorf(msg.RequestID, "invalid required fields for presence query (accountinfo_ids, up to %d)", message.PageSizeMax)
+		}
 	default:
-		return nil, fmt.Errorf("invalid message type (%q for sending new messages or %q for marking messages as seen)", message.MsgTypeMessageNew, message.MsgTypeNotificationRead)
+		return nil, invalidMessageErrorf(msg.RequestID, "invalid message type (must be one of %q)", message.InputMsgTypes)
 	}
 	return msg, nil
 }
 
+func validPollOptions(options []string) bool {
+	if len(options) < 2 || len(options) > message.PollOptionMax {
+		return false
+	}
+	for i, option := range options {
+		if option == "" || len(option) > message.PollOptionMaxLength || slices.Contains(options[:i], option) {
+			return false
+		}
+	}
+	return true
+}
+
+// validChecksum reports whether checksum is a hex-encoded SHA-256 digest.
+func validChecksum(checksum string) bool {
+	if len(checksum) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(checksum)
+	return err == nil
+}
+
+const (
+	zeroWidthJoiner   = '\u200d'
+	variationSelector = '\ufe0f'
+	combiningKeycap   = '\u20e3'
+	cancelTag         = '\U000e007f'
+)
+
+// pictographicRanges are the code points which can start an emoji, besides the regional indicators and keycaps.
+var pictographicRanges = [][2]rune{
+	{0x00a9, 0x00a9}, {0x00ae, 0x00ae}, {0x203c, 0x203c}, {0x2049, 0x2049}, {0x2122, 0x2122}, {0x2139, 0x2139},
+	{0x2194, 0x2199}, {0x21a9, 0x21aa}, {0x231a, 0x231b}, {0x2328, 0x2328}, {0x23cf, 0x23cf}, {0x23e9, 0x23f3},
+	{0x23f8, 0x23fa}, {0x24c2, 0x24c2}, {0x25aa, 0x25ab}, {0x25b6, 0x25b6}, {0x25c0, 0x25c0}, {0x25fb, 0x25fe},
+	{0x2600, 0x27bf}, {0x2934, 0x2935}, {0x2b05, 0x2b07}, {0x2b1b, 0x2b1c}, {0x2b50, 0x2b50}, {0x2b55, 0x2b55},
+	{0x3030, 0x3030}, {0x303d, 0x303d}, {0x3297, 0x3297}, {0x3299, 0x3299}, {0x1f000, 0x1f1e5}, {0x1f200, 0x1f3fa},
+	{0x1f400, 0x1faff},
+}
+
+func isPictographic(r rune) bool {
+	for _, pictographicRange := range pictographicRanges {
+		if r >= pictographicRange[0] && r <= pictographicRange[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+func isEmojiModifier(r rune) bool {
+	return r == variationSelector || (r >= 0x1f3fb && r <= 0x1f3ff)
+}
+
+func isTag(r rune) bool {
+	return r >= 0xe0020 && r <= 0xe007e
+}
+
+// validReaction reports whether reaction is a single emoji: a flag, a keycap, or pictographs joined by zero width
+// joiners, each with its skin tone and variation selector, optionally followed by a tag sequence.
+func validReaction(reaction string) bool {
+	if reaction == "" || len(reaction) > message.ReactionMaxLength {
+		return false
+	}
+	runes := []rune(reaction)
+	if isRegionalIndicator(runes[0]) {
+		return len(runes) == 2 && isRegionalIndicator(runes[1])
+	}
+	if strings.ContainsRune("0123456789#*", runes[0]) {
+		rest := runes[1:]
+		if len(rest) > 0 && rest[0] == variationSelector {
+			rest = rest[1:]
+		}
+		return len(rest) == 1 && rest[0] == combiningKeycap
+	}
+	for i := 0; i < len(runes); i++ {
+		if !isPictographic(runes[i]) {
+			return false
+		}
+		for i+1 < len(runes) && isEmojiModifier(runes[i+1]) {
+			i++
+		}
+		if i+1 < len(runes) && isTag(runes[i+1]) {
+			for i+1 < len(runes) && isTag(runes[i+1]) {
+				i++
+			}
+			return i+2 == len(runes) && runes[i+1] == cancelTag
+		}
+		if i+1 == len(runes) {
+			return true
+		}
+		// another pictograph must follow the joiner
+		if runes[i+1] != zeroWidthJoiner {
+			return false
+		}
+		i++
+	}
+	return false
+}
+
+// WriteJSONMessage queues a message to be written by the writer goroutine, without waiting for the write itself.
 func (c *WSConnection) WriteJSONMessage(msg *message.OutputMessage) error {
-	c.mutex.Lock() // lock & unlock mutex to prevent concurrent writes
-	defer c.mutex.Unlock()
-	return c.Conn.WriteJSON(msg)
+	select {
+	case <-c.done:
+		return ErrConnectionClosed
+	default:
+	}
+	if len(c.closeRequest) > 0 {
+		return ErrConnectionClosed
+	}
+	for {
+		select {
+		case c.send <- msg:
+			c.sendQueueDepth.Inc()
+			select {
+			case <-c.done:
+				// the connection was closed meanwhile, after its queue was drained
+				c._drainSendQueue()
+				return ErrConnectionClosed
+			default:
+			}
+			return nil
+		default:
+		}
+		// the queue is full, apply the overflow policy
+		switch conf.WS_SEND_QUEUE_POLICY {
+		case SendQueuePolicyDropNewest:
+			c.sendQueueDropped.WithLabelValues(SendQueuePolicyDropNewest).Inc()
+			return ErrSendQueueFull
+		case SendQueuePolicyDisconnect:
+			c.sendQueueDropped.WithLabelValues(SendQueuePolicyDisconnect).Inc()
+			c._requestClose(websocket.CloseTryAgainLater, "send queue overflow")
+			return ErrSendQueueFull
+		default: // SendQueuePolicyDropOldest, the policy is validated when loading the configuration
+			select {
+			case <-c.send:
+				c.sendQueueDepth.Dec()
+				c.sendQueueDropped.WithLabelValues(SendQueuePolicyDropOldest).Inc()
+			default:
+			}
+			// retry with the freed slot
+		}
+	}
+}
+
+// InvalidMessageError is returned by ReadJSONMessage when a frame was read successfully but its content is invalid.
+// The connection itself is still usable after this error.
+type InvalidMessageError struct {
+	Err       error
+	RequestID string // empty if the frame could not be parsed
+}
+
+func (e *InvalidMessageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InvalidMessageError) Unwrap() error {
+	return e.Err
+}
+
+func invalidMessageErrorf(requestID string, format string, a ...any) error {
+	return &InvalidMessageError{Err: fmt.Errorf(format, a...), RequestID: requestID}
+}
+
+// IsTimeoutError reports whether err was caused by the peer not answering the heartbeat in time.
+func IsTimeoutError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
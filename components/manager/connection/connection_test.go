@@ -0,0 +1,405 @@
+package connection
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/manager/message"
+	conf "github.com/khanhnguyen02311/EchoChat-WS/configurations"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testGroup    = `"00000000-0000-0000-0000-000000000001"`
+	testTarget   = `{"group_id": ` + testGroup + `, "time_created": "2023-01-01T12:12:12.121Z", "accountinfo_id": 1}`
+	testUpload   = `"00000000-0000-0000-0000-000000000002"`
+	testChecksum = `"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"`
+)
+
+// TestMain sets the configuration read by the goroutines of the connections, which may outlive their test.
+func TestMain(m *testing.M) {
+	conf.WS_PONG_WAIT = time.Minute
+	conf.WS_PING_INTERVAL = time.Minute
+	conf.WS_WRITE_WAIT = time.Second
+	conf.WS_INBOUND_QUEUE_SIZE = 16
+	conf.UPLOAD_MAX_SIZE = 1 << 20
+	conf.UPLOAD_CHUNK_SIZE = 16
+	os.Exit(m.Run())
+}
+
+type readResult struct {
+	msg *message.InputMessage
+	err error
+}
+
+// newTestConnection returns a client connection to a server which reads every frame with ReadJSONMessage.
+func newTestConnection(t *testing.T) (*websocket.Conn, <-chan readResult) {
+	conf.WS_SEND_QUEUE_SIZE = 16
+	results := make(chan readResult)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := NewWSConnection(conn, 1, "client", nil, nil)
+		for {
+			msg, err := c.ReadJSONMessage()
+			var invalid *InvalidMessageError
+			if err != nil && !errors.As(err, &invalid) {
+				_ = conn.Close()
+				return
+			}
+			results <- readResult{msg: msg, err: err}
+		}
+	}))
+	t.Cleanup(server.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return client, results
+}
+
+func TestReadJSONMessage(t *testing.T) {
+	client, results := newTestConnection(t)
+	tests := []struct {
+		name      string
+		frame     string
+		valid     bool
+		requestID string // of the error
+		check     func(msg *message.InputMessage) bool
+	}{
+		{name: "malformed json", frame: `{"type": `},
+		{name: "unknown type", frame: `{"type": "unknown", "request_id": "r1"}`, requestID: "r1"},
+		{name: "new message", frame: `{"type": "message-new", "data": {"group_id": ` + testGroup + `, "content": "hi", "type": "Message"}}`, valid: true},
+		{name: "new message without data", frame: `{"type": "message-new", "request_id": "r2"}`, requestID: "r2"},
+		{name: "new message without content", frame: `{"type": "message-new", "data": {"group_id": ` + testGroup + `, "type": "Message"}}`},
+		{name: "new message of unknown type", frame: `{"type": "message-new", "data": {"content": "hi", "type": "Other"}}`},
+		{name: "new message expiring too late", frame: `{"type": "message-new", "data": {"content": "hi", "type": "Message", "expires_in": 2592001}}`},
+		{name: "new message with negative expiry", frame: `{"type": "message-new", "data": {"content": "hi", "type": "Message", "expires_in": -1}}`},
+		{name: "poll", frame: `{"type": "message-new", "data": {"content": "?", "type": "Poll", "options": ["a", "b"]}}`, valid: true},
+		{name: "poll with one option", frame: `{"type": "message-new", "data": {"content": "?", "type": "Poll", "options": ["a"]}}`},
+		{name: "poll with duplicate options", frame: `{"type": "message-new", "data": {"content": "?", "type": "Poll", "options": ["a", "a"]}}`},
+		{name: "poll with empty option", frame: `{"type": "message-new", "data": {"content": "?", "type": "Poll", "options": ["a", ""]}}`},
+		{
+			name: "history with default limit", frame: `{"type": "message-history", "data": {"group_id": ` + testGroup + `}}`, valid: true,
+			check: func(msg *message.InputMessage) bool { return msg.Data.Limit == message.PageSizeDefault },
+		},
+		{name: "history over the page size", frame: `{"type": "message-history", "data": {"group_id": ` + testGroup + `, "limit": 101}}`},
+		{
+			name: "notification list with default limit", frame: `{"type": "notification-list", "data": {"type": "Reply"}}`, valid: true,
+			check: func(msg *message.InputMessage) bool { return msg.Data.Limit == message.PageSizeDefault },
+		},
+		{name: "notification list of unknown type", frame: `{"type": "notification-list", "data": {"type": "Unknown"}}`},
+		{name: "notification list without type", frame: `{"type": "notification-list", "data": {}}`},
+		{name: "notification read-all without data", frame: `{"type": "notification-read-all"}`, valid: true},
+		{name: "thread without target", frame: `{"type": "message-thread", "data": {}}`},
+		{name: "edit", frame: `{"type": "message-edit", "data": {"target": ` + testTarget + `, "content": "edited"}}`, valid: true},
+		{name: "edit without content", frame: `{"type": "message-edit", "data": {"target": ` + testTarget + `}}`},
+		{name: "delete without target", frame: `{"type": "message-delete", "data": {}}`},
+		{name: "reaction", frame: `{"type": "reaction-add", "data": {"target": ` + testTarget + `, "content": "👍"}}`, valid: true},
+		{name: "reaction with skin tone", frame: `{"type": "reaction-add", "data": {"target": ` + testTarget + `, "content": "👍🏽"}}`, valid: true},
+		{name: "reaction with variation selector", frame: `{"type": "reaction-add", "data": {"target": ` + testTarget + `, "content": "❤️"}}`, valid: true},
+		{name: "reaction flag", frame: `{"type": "reaction-add", "data": {"target": ` + testTarget + `, "content": "🇻🇳"}}`, valid: true},
+		{name: "reaction keycap", frame: `{"type": "reaction-add", "data": {"target": ` + testTarget + `, "content": "1️⃣"}}`, valid: true},
+		{name: "reaction ZWJ sequence", frame: `{"type": "reaction-add", "data": {"target": ` + testTarget + `, "content": "👨‍👩‍👧‍👦"}}`, valid: true},
+		{name: "reaction tag sequence", frame: `{"type": "reaction-add", "data": {"target": ` + testTarget + `, "content": "` + "🏴\U000e0067\U000e0062\U000e0073\U000e0063\U000e0074\U000e007f" + `"}}`, valid: true},
+		{name: "reaction text", frame: `{"type": "reaction-add", "data": {"target": ` + testTarget + `, "content": "ok"}}`},
+		{name: "reaction of two emojis", frame: `{"type": "reaction-add", "data": {"target": ` + testTarget + `, "content": "👍👍"}}`},
+		{name: "reaction ending with a joiner", frame: `{"type": "reaction-add", "data": {"target": ` + testTarget + `, "content": "👍\u200d"}}`},
+		{name: "reaction of half a flag", frame: `{"type": "reaction-add", "data": {"target": ` + testTarget + `, "content": "🇻"}}`},
+		{name: "reaction too long", frame: `{"type": "reaction-add", "data": {"target": ` + testTarget + `, "content": "` + strings.Repeat("👍\u200d", 10) + `👍"}}`},
+		{name: "vote without choices", frame: `{"type": "poll-vote", "data": {"target": ` + testTarget + `}}`},
+		{name: "forward without groups", frame: `{"type": "message-forward", "data": {"target": ` + testTarget + `}}`},
+		{name: "upload begin", frame: `{"type": "upload-begin", "data": {"content": "a.txt", "file_size": 10, "checksum": ` + testChecksum + `}}`, valid: true},
+		{name: "upload resume", frame: `{"type": "upload-begin", "data": {"upload_id": ` + testUpload + `}}`, valid: true},
+		{name: "upload too large", frame: `{"type": "upload-begin", "data": {"content": "a.txt", "file_size": 1048577, "checksum": ` + testChecksum + `}}`},
+		{name: "upload with invalid checksum", frame: `{"type": "upload-begin", "data": {"content": "a.txt", "file_size": 10, "checksum": "abc"}}`},
+		{name: "upload with invalid mime", frame: `{"type": "upload-begin", "data": {"upload_id": ` + testUpload + `, "file_mime": "/"}}`},
+		{name: "upload chunk", frame: `{"type": "upload-chunk", "data": {"upload_id": ` + testUpload + `, "chunk": "YWJj", "checksum": ` + testChecksum + `}}`, valid: true},
+		{name: "upload chunk too large", frame: `{"type": "upload-chunk", "data": {"upload_id": ` + testUpload + `, "chunk": "` + strings.Repeat("YWJj", 6) + `", "checksum": ` + testChecksum + `}}`},
+		{name: "upload chunk with negative offset", frame: `{"type": "upload-chunk", "data": {"upload_id": ` + testUpload + `, "offset": -1, "chunk": "YWJj", "checksum": ` + testChecksum + `}}`},
+		{name: "upload commit without upload", frame: `{"type": "upload-commit", "data": {}}`},
+		{name: "scheduled cancel without send_at", frame: `{"type": "scheduled-cancel", "data": {"scheduled_id": ` + testUpload + `}}`},
+		{name: "focus on too many groups", frame: `{"type": "group-focus", "data": {"group_ids": [` + strings.Repeat(testGroup+",", 100) + testGroup + `]}}`},
+		{name: "focus on no group", frame: `{"type": "group-focus", "data": {"group_ids": []}}`, valid: true},
+		{name: "presence query without accounts", frame: `{"type": "presence-query", "data": {"accountinfo_ids": []}}`},
+		{name: "typing without data", frame: `{"type": "typing-start"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := client.WriteMessage(websocket.TextMessage, []byte(test.frame)); err != nil {
+				t.Fatal(err)
+			}
+			var result readResult
+			select {
+			case result = <-results:
+			case <-time.After(time.Second):
+				t.Fatal("the frame was not read")
+			}
+			if !test.valid {
+				var invalid *InvalidMessageError
+				if !errors.As(result.err, &invalid) {
+					t.Fatalf("error %v, want an InvalidMessageError", result.err)
+				}
+				if invalid.RequestID != test.requestID {
+					t.Errorf("request id %q, want %q", invalid.RequestID, test.requestID)
+				}
+				return
+			}
+			if result.err != nil {
+				t.Fatalf("error %v", result.err)
+			}
+			if test.check != nil && !test.check(result.msg) {
+				t.Errorf("unexpected message %+v", result.msg.Data)
+			}
+		})
+	}
+}
+
+// newTestPair returns the server side of a connection, whose writer is not started, and its client side.
+func newTestPair(t *testing.T) (*WSConnection, *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	depth := prometheus.NewGauge(prometheus.GaugeOpts{Name: "send_queue_depth"})
+	dropped := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "send_queue_dropped_total"}, []string{"policy"})
+	c := NewWSConnection(<-conns, 1, "client", depth, dropped)
+	t.Cleanup(func() { _ = c.Close() })
+	return c, client
+}
+
+func metricValue(t *testing.T, collector prometheus.Metric) float64 {
+	var metric dto.Metric
+	if err := collector.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	if metric.Gauge != nil {
+		return metric.Gauge.GetValue()
+	}
+	return metric.Counter.GetValue()
+}
+
+func TestWriteJSONMessagePolicies(t *testing.T) {
+	conf.WS_SEND_QUEUE_SIZE = 2
+	tests := []struct {
+		policy  string
+		errs    []error  // of the 4 writes
+		queued  []string // contents left in the queue
+		dropped float64
+	}{
+		{
+			policy:  SendQueuePolicyDropOldest,
+			errs:    []error{nil, nil, nil, nil},
+			queued:  []string{"3", "4"},
+			dropped: 2,
+		},
+		{
+			policy:  SendQueuePolicyDropNewest,
+			errs:    []error{nil, nil, ErrSendQueueFull, ErrSendQueueFull},
+			queued:  []string{"1", "2"},
+			dropped: 2,
+		},
+		{
+			policy:  SendQueuePolicyDisconnect,
+			errs:    []error{nil, nil, ErrSendQueueFull, ErrConnectionClosed},
+			queued:  []string{"1", "2"},
+			dropped: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			conf.WS_SEND_QUEUE_POLICY = test.policy
+			c, _ := newTestPair(t)
+			// the writer is not started, as if it was stuck on a slow peer
+			for i, want := range test.errs {
+				err := c.WriteJSONMessage(message.NewOutputMessage(message.MsgTypeMessage, message.MsgStatusNew, strconv.Itoa(i+1)))
+				if !errors.Is(err, want) {
+					t.Errorf("write %d: error %v, want %v", i+1, err, want)
+				}
+			}
+			if depth := metricValue(t, c.sendQueueDepth); depth != float64(len(test.queued)) {
+				t.Errorf("depth %v, want %d", depth, len(test.queued))
+			}
+			if dropped := metricValue(t, c.sendQueueDropped.WithLabelValues(test.policy)); dropped != test.dropped {
+				t.Errorf("dropped %v, want %v", dropped, test.dropped)
+			}
+			var queued []string
+			for len(c.send) > 0 {
+				queued = append(queued, (<-c.send).Content)
+			}
+			if strings.Join(queued, ",") != strings.Join(test.queued, ",") {
+				t.Errorf("queued %v, want %v", queued, test.queued)
+			}
+		})
+	}
+}
+
+func TestWriteJSONMessageDisconnect(t *testing.T) {
+	conf.WS_SEND_QUEUE_SIZE = 1
+	conf.WS_SEND_QUEUE_POLICY = SendQueuePolicyDisconnect
+	c, client := newTestPair(t)
+	for i := 0; i < 2; i++ {
+		_ = c.WriteJSONMessage(message.NewOutputMessage(message.MsgTypeMessage, message.MsgStatusNew, ""))
+	}
+	reads := make(chan error, 1)
+	go func() {
+		_, _, err := client.ReadMessage()
+		reads <- err
+	}()
+	// the sender does not write the close frame itself
+	select {
+	case err := <-reads:
+		t.Fatalf("read %v before the writer started", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.StartWriter()
+	var err error
+	select {
+	case err = <-reads:
+	case <-time.After(time.Second):
+		t.Fatal("no close frame")
+	}
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Fatalf("read %v, want a close frame before the queued message", err)
+	}
+	<-c.done
+	if depth := metricValue(t, c.sendQueueDepth); depth != 0 {
+		t.Errorf("depth %v after close, want 0", depth)
+	}
+}
+
+func TestWriteJSONMessageClosed(t *testing.T) {
+	conf.WS_SEND_QUEUE_SIZE = 4
+	conf.WS_SEND_QUEUE_POLICY = SendQueuePolicyDropOldest
+	c, _ := newTestPair(t)
+	if err := c.WriteJSONMessage(message.NewOutputMessage(message.MsgTypeMessage, message.MsgStatusNew, "")); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+	if err := c.WriteJSONMessage(message.NewOutputMessage(message.MsgTypeMessage, message.MsgStatusNew, "")); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("error %v, want %v", err, ErrConnectionClosed)
+	}
+	if depth := metricValue(t, c.sendQueueDepth); depth != 0 {
+		t.Errorf("depth %v after close, want 0", depth)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+		err   error
+	}{
+		{
+			name:  "largest chunk",
+			frame: `{"type": "upload-chunk", "data": {"upload_id": ` + testUpload + `, "chunk": "` + strings.Repeat("A", 22) + `==", "checksum": ` + testChecksum + `}}`,
+		},
+		{
+			name:  "frame over the limit",
+			frame: `{"type": "message-new", "data": {"content": "` + strings.Repeat("a", readLimitOverhead) + `", "type": "Message"}}`,
+			err:   websocket.ErrReadLimit,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, client := newTestPair(t)
+			if err := client.WriteMessage(websocket.TextMessage, []byte(test.frame)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.ReadJSONMessage(); !errors.Is(err, test.err) {
+				t.Errorf("error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+// newHeartbeatPair returns a pair like newTestPair, with a heartbeat short enough for a test.
+func newHeartbeatPair(t *testing.T) (*WSConnection, *websocket.Conn) {
+	c, client := newTestPair(t)
+	c.pingInterval = 20 * time.Millisecond
+	c.pongWait = 100 * time.Millisecond
+	_ = c._extendReadDeadline()
+	return c, client
+}
+
+func TestHeartbeatReaping(t *testing.T) {
+	c, _ := newHeartbeatPair(t)
+	// the client never reads, so it never answers the pings
+	c.StartWriter()
+	start := time.Now()
+	if _, err := c.ReadJSONMessage(); !IsTimeoutError(err) {
+		t.Fatalf("error %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("reaped after %v, want about %v", elapsed, c.pongWait)
+	}
+}
+
+func TestHeartbeatKeepsAlive(t *testing.T) {
+	c, client := newHeartbeatPair(t)
+	// reading makes the client answer the pings
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	c.StartWriter()
+	reads := make(chan error, 1)
+	go func() {
+		_, err := c.ReadJSONMessage()
+		reads <- err
+	}()
+	select {
+	case err := <-reads:
+		t.Fatalf("read %v while the client answered the pings", err)
+	case <-time.After(3 * c.pongWait):
+	}
+	if err := client.WriteMessage(websocket.TextMessage, []byte(`{"type": "notification-read-all"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-reads; err != nil {
+		t.Fatalf("error %v, want the message", err)
+	}
+	if c.Reaped() {
+		t.Error("reaped while alive")
+	}
+}
+
+func TestHeartbeatPingFailure(t *testing.T) {
+	c, _ := newHeartbeatPair(t)
+	// the next ping cannot be written
+	_ = c.Conn.UnderlyingConn().Close()
+	c.StartWriter()
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+	if !c.Reaped() {
+		t.Error("not reaped after the ping failed")
+	}
+}
@@ -1,28 +1,44 @@
 package manager
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/gocql/gocql"
 	"github.com/gorilla/websocket"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/db"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/db/dbmodels"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/handler"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/manager/connection"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/manager/message"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/manager/presence"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/manager/session"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/manager/typing"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/services/proto"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/services/servicemodels"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/services/storage"
 	conf "github.com/khanhnguyen02311/EchoChat-WS/configurations"
 	"github.com/labstack/echo/v4"
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/exp/slices"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// messageDetailsConcurrency bounds the queries run at once by _loadMessageDetails for a page of messages.
+const messageDetailsConcurrency = 8
+
 var (
 	upgrader = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
@@ -35,24 +51,41 @@ var (
 //
 // It uses Echo to handle the HTTP requests/metrics/logging and custom Gorilla Websockets to handle the WebSocket connections.
 // Each client ID can have multiple connections stored in a slice.
+// Events for clients are sent through their sessions, which survive reconnections.
 type ConnectionManager struct {
-	MessageReceivedCounter *prometheus.CounterVec
-	MessageSentCounter     *prometheus.CounterVec
-	connectionsByID        map[int][]*connection.WSConnection
-	connectionsByIDMutex   sync.RWMutex
-	server                 *echo.Echo
-	db                     *db.ScyllaDB
+	MessageReceivedCounter  *prometheus.CounterVec
+	MessageSentCounter      *prometheus.CounterVec
+	SendQueueDepthGauge     prometheus.Gauge
+	SendQueueDroppedCounter *prometheus.CounterVec
+	connectionsByID         map[int][]*connection.WSConnection
+	connectionsByIDMutex    sync.RWMutex
+	sessions                *session.Store
+	typing                  *typing.Tracker
+	presence                *presence.Tracker
+	server                  *echo.Echo
+	db                      *db.ScyllaDB
+	store                   storage.ObjectStore
 }
 
-func NewConnectionManager(e *echo.Echo, db *db.ScyllaDB, msgSentCounter *prometheus.CounterVec, msgReceivedCounter *prometheus.CounterVec) *ConnectionManager {
-	return &ConnectionManager{
-		MessageSentCounter:     msgSentCounter,
-		MessageReceivedCounter: msgReceivedCounter,
-		connectionsByID:        make(map[int][]*connection.WSConnection),
-		connectionsByIDMutex:   sync.RWMutex{},
-		server:                 e,
-		db:                     db,
+func NewConnectionManager(e *echo.Echo, db *db.ScyllaDB, store storage.ObjectStore, msgSentCounter *prometheus.CounterVec, msgReceivedCounter *prometheus.CounterVec,
+	sendQueueDepthGauge prometheus.Gauge, sendQueueDroppedCounter *prometheus.CounterVec) *ConnectionManager {
+	manager := &ConnectionManager{
+		MessageSentCounter:      msgSentCounter,
+		MessageReceivedCounter:  msgReceivedCounter,
+		SendQueueDepthGauge:     sendQueueDepthGauge,
+		SendQueueDroppedCounter: sendQueueDroppedCounter,
+		connectionsByID:         make(map[int][]*connection.WSConnection),
+		connectionsByIDMutex:    sync.RWMutex{},
+		sessions:                session.NewStore(),
+		server:                  e,
+		db:                      db,
+		store:                   store,
 	}
+	manager.typing = typing.NewTracker(func(groupID gocql.UUID, clientID int) {
+		manager._relayTyping(groupID, clientID, message.MsgStatusStop)
+	})
+	manager.presence = presence.NewTracker(manager._sendPresence)
+	return manager
 }
 
 func (manager *ConnectionManager) _validateClient(token string) (int, string) {
@@ -73,15 +106,20 @@ func (manager *ConnectionManager) _validateClient(token string) (int, string) {
 	return int(resp.GetId()), resp.GetName()
 }
 
+// _getConnectionsMutex returns a copy of the connections of a client, which _removeConnectionsMutex cannot shift while
+// the caller iterates over it.
 func (manager *ConnectionManager) _getConnectionsMutex(clientID int) []*connection.WSConnection {
 	manager.connectionsByIDMutex.RLock()
 	defer manager.connectionsByIDMutex.RUnlock()
-	return manager.connectionsByID[clientID]
+	return append([]*connection.WSConnection(nil), manager.connectionsByID[clientID]...)
 }
 
 func (manager *ConnectionManager) _addConnectionsMutex(conn *connection.WSConnection) {
 	manager.connectionsByIDMutex.Lock()
 	defer manager.connectionsByIDMutex.Unlock()
+	if len(manager.connectionsByID[conn.ClientID]) == 0 {
+		manager.presence.Connected(conn.ClientID)
+	}
 	manager.connectionsByID[conn.ClientID] = append(manager.connectionsByID[conn.ClientID], conn)
 }
 
@@ -95,6 +133,7 @@ func (manager *ConnectionManager) _removeConnectionsMutex(conn *connection.WSCon
 		}
 		if len(manager.connectionsByID[c.ClientID]) == 1 {
 			delete(manager.connectionsByID, c.ClientID)
+			manager.presence.Disconnected(c.ClientID)
 		} else {
 			manager.connectionsByID[c.ClientID] = append(
 				manager.connectionsByID[c.ClientID][:i], manager.connectionsByID[c.ClientID][i+1:]...)
@@ -103,75 +142,920 @@ func (manager *ConnectionManager) _removeConnectionsMutex(conn *connection.WSCon
 	}
 }
 
-func (manager *ConnectionManager) _sendNotificationsForNewMessage(messageDB *dbmodels.Message, messageRMQ *servicemodels.RMQMessage) {
-	notification := dbmodels.Notification{
-		AccountinfoID: 0, // iterated later
-		Type:          dbmodels.DBNotificationType[0],
-	}
-	// bind data to notification
-	if messageDB != nil {
-		notification.GroupID = messageDB.GroupID
-		notification.AccountinfoIDSender = messageDB.AccountinfoID
-		notification.Content = messageDB.AccountinfoName + ": " + messageDB.Content
-		notification.TimeCreated = messageDB.TimeCreated.UTC()
-	} else {
-		notification.GroupID = messageRMQ.GroupID
-		notification.AccountinfoIDSender = messageRMQ.AccountinfoID
-		notification.Content = messageRMQ.AccountinfoName + ": " + messageRMQ.Content
-		notification.TimeCreated = messageRMQ.TimeCreated.UTC()
+func (manager *ConnectionManager) _messageFromRMQ(messageRMQ *servicemodels.RMQMessage) *dbmodels.Message {
+	messageDB := dbmodels.Message{
+		GroupID:         messageRMQ.GroupID,
+		AccountinfoID:   messageRMQ.AccountinfoID,
+		Content:         messageRMQ.Content,
+		Type:            messageRMQ.Type,
+		AccountinfoName: messageRMQ.AccountinfoName,
+		GroupName:       messageRMQ.GroupName,
+		TimeCreated:     time.Now().UTC(),
+	}
+	if messageRMQ.TimeCreated != nil {
+		messageDB.TimeCreated = messageRMQ.TimeCreated.UTC()
 	}
+	return &messageDB
+}
+
+// _sendNewMessage delivers a new message to every online participant of its group, then notifies them.
+func (manager *ConnectionManager) _sendNewMessage(messageDB *dbmodels.Message) {
 	// query all participants of that group
-	listID, err := handler.NewParticipantHandler(manager.db).GetAllParticipantIDsFromGroup(notification.GroupID)
+	participants, err := handler.NewParticipantHandler(manager.db).GetAllParticipantsFromGroup(messageDB.GroupID)
 	if err != nil {
 		fmt.Println("Error getting all participants:", err.Error())
 		return
 	}
-	if len(listID) == 0 {
+	if len(participants) == 0 {
 		fmt.Println("No participants found")
 		return
 	}
+	listID := make([]int, 0, len(participants))
+	for _, participant := range participants {
+		listID = append(listID, participant.AccountinfoID)
+	}
+	// send the full message to clients, so they can render it right away, even if they muted the group
+	outputMsg := message.NewOutputMessage(message.MsgTypeMessage, message.MsgStatusNew, "")
+	outputMsg.Message = messageDB
+	manager.SendToClients(listID, outputMsg)
+	manager._sendNotificationsForNewMessage(messageDB, participants)
+}
+
+// _sendMessageUpdate delivers a changed message to every online participant of its group.
+func (manager *ConnectionManager) _sendMessageUpdate(messageDB *dbmodels.Message, status string) {
+	listID, err := handler.NewParticipantHandler(manager.db).GetAllParticipantIDsFromGroup(messageDB.GroupID)
+	if err != nil {
+		fmt.Println("Error getting all participants:", err.Error())
+		return
+	}
+	outputMsg := message.NewOutputMessage(message.MsgTypeMessage, status, "")
+	outputMsg.Message = messageDB
+	manager.SendToClients(listID, outputMsg)
+}
+
+// _prepareNewMessage builds a new message of a participant from its input, checking that it can be sent.
+//
+// The message is not stored yet, see _addNewMessage.
+func (manager *ConnectionManager) _prepareNewMessage(senderID int, senderName string, data *dbmodels.MessagePOST, timeCreated time.Time) (*dbmodels.Message, error) {
+	groupHandler := handler.NewGroupHandler(manager.db)
+	group, err := groupHandler.GetGroupByID(data.GroupID)
+	if err != nil || group == nil {
+		return nil, errors.New("group not found")
+	}
+	participant, err := handler.NewParticipantHandler(manager.db).CheckJoinedParticipant(senderID, group.ID)
+	if err != nil || participant == nil {
+		return nil, errors.New("not a participant of this group")
+	}
+	newMessage := dbmodels.Message{
+		AccountinfoID:   senderID,
+		GroupID:         data.GroupID,
+		Content:         data.Content,
+		TimeCreated:     timeCreated.UTC().Truncate(time.Millisecond), // Scylla timestamps have millisecond precision
+		Type:            data.Type,
+		AccountinfoName: senderName,
+		GroupName:       group.Name,
+	}
+	if data.ReplyTo != nil {
+		if data.ReplyTo.GroupID != newMessage.GroupID {
+			return nil, errors.New("can only reply to a message of the same group")
+		}
+		parent, err := handler.NewMessageHandler(manager.db).GetMessage(newMessage.GroupID, data.ReplyTo.TimeCreated.UTC(), data.ReplyTo.AccountinfoID)
+		if err != nil || parent.Deleted {
+			return nil, errors.New("replied message not found")
+		}
+		newMessage.ReplyToTimeCreated = &parent.TimeCreated
+		newMessage.ReplyToAccountinfoID = &parent.AccountinfoID
+	}
+	if err := manager._setMentions(&newMessage, participant); err != nil {
+		return nil, err
+	}
+	if newMessage.Type == dbmodels.DBMessageType[2] {
+		if data.ClosesAt != nil && !data.ClosesAt.After(time.Now()) {
+			return nil, errors.New("closes_at must be in the future")
+		}
+		newMessage.Poll = &dbmodels.Poll{
+			GroupID:              newMessage.GroupID,
+			MessageTimeCreated:   newMessage.TimeCreated,
+			MessageAccountinfoID: newMessage.AccountinfoID,
+			Options:              data.Options,
+			MultipleChoice:       data.MultipleChoice,
+			TimeClosed:           data.ClosesAt,
+			Votes:                make([]int, len(data.Options)),
+		}
+	}
+	// without an expiry of its own, the message follows the retention of the group
+	expiresIn := data.ExpiresIn
+	if expiresIn == 0 {
+		setting, err := groupHandler.GetGroupSetting(group.ID)
+		if err != nil {
+			return nil, err
+		}
+		if setting != nil {
+			expiresIn = setting.MessageTTL
+		}
+	}
+	if expiresIn > 0 {
+		timeExpired := newMessage.TimeCreated.Add(time.Duration(expiresIn) * time.Second)
+		newMessage.TimeExpired = &timeExpired
+	}
+	return &newMessage, nil
+}
+
+// _addNewMessage stores a message prepared by _prepareNewMessage, then delivers it to the participants.
+func (manager *ConnectionManager) _addNewMessage(newMessage *dbmodels.Message) error {
+	messageHandler := handler.NewMessageHandler(manager.db)
+	// the poll comes first, a poll without its message is never read
+	if newMessage.Poll != nil {
+		if err := handler.NewPollHandler(manager.db).AddPoll(newMessage.Poll, newMessage); err != nil {
+			return err
+		}
+	}
+	// so does the file reference, a file referenced by a missing message is only kept longer
+	if newMessage.FileID != nil {
+		if err := handler.NewFileUploadHandler(manager.db).AddFileReference(newMessage); err != nil {
+			return err
+		}
+	}
+	if err := messageHandler.AddNewMessage(newMessage); err != nil {
+		return err
+	}
+	if newMessage.ReplyTo() != nil {
+		// the message itself is stored, a retry would duplicate it
+		_ = messageHandler.AddReply(newMessage)
+	}
+	manager._sendNewMessage(newMessage)
+	manager._scheduleExpiry(newMessage)
+	return nil
+}
+
+// _getUpload returns an upload of the client.
+func (manager *ConnectionManager) _getUpload(clientID int, uploadID gocql.UUID) (*dbmodels.FileUpload, error) {
+	upload, err := handler.NewFileUploadHandler(manager.db).GetUpload(uploadID)
+	if err != nil || upload == nil || upload.AccountinfoID != clientID {
+		return nil, errors.New("upload not found")
+	}
+	return upload, nil
+}
+
+// _assembleUpload concatenates the chunks of a complete upload into its file, and checks the checksum of the file.
+//
+// The chunks are streamed from the object store, the file is never held in memory.
+func (manager *ConnectionManager) _assembleUpload(upload *dbmodels.FileUpload) error {
+	ctx := context.Background()
+	parts := (upload.FileSize + int64(upload.ChunkSize) - 1) / int64(upload.ChunkSize)
+	reader, writer := io.Pipe()
+	go func() {
+		for i := int64(0); i < parts; i++ {
+			part, err := manager.store.Get(ctx, storage.PartKey(upload.ID.String(), i))
+			if err != nil {
+				_ = writer.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(writer, part)
+			_ = part.Close()
+			if err != nil {
+				_ = writer.CloseWithError(err)
+				return
+			}
+		}
+		_ = writer.Close()
+	}()
+	hash := sha256.New()
+	fileKey := storage.FileKey(upload.ID.String())
+	err := manager.store.Put(ctx, fileKey, io.TeeReader(reader, hash), upload.FileSize, upload.FileMime)
+	// stops the chunk reader if the object store gave up early
+	_ = reader.Close()
+	if err != nil {
+		fmt.Println("An error occurred while assembling upload", upload.ID.String(), err.Error())
+		return errors.New("the file could not be stored, please retry")
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != upload.Checksum {
+		_ = manager.store.Delete(ctx, fileKey)
+		return errors.New("file checksum mismatch")
+	}
+	return nil
+}
+
+// _removeUploadParts removes the chunks of an upload, and returns the last error, if any. Missing chunks are skipped.
+func (manager *ConnectionManager) _removeUploadParts(uploadID gocql.UUID, parts int64) error {
+	var lastErr error
+	for i := int64(0); i < parts; i++ {
+		if err := manager.store.Delete(context.Background(), storage.PartKey(uploadID.String(), i)); err != nil {
+			fmt.Println("An error occurred while removing upload chunk", uploadID.String(), err.Error())
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// _releaseFile removes the reference of a File message to its file, then the file itself once no message references it.
+func (manager *ConnectionManager) _releaseFile(fileID gocql.UUID, key *dbmodels.MessageKey) error {
+	referenced, err := handler.NewFileUploadHandler(manager.db).RemoveFileReference(fileID, key)
+	if err != nil || referenced {
+		return err
+	}
+	if err := manager.store.Delete(context.Background(), storage.FileKey(fileID.String())); err != nil {
+		fmt.Println("An error occurred while removing file", fileID.String(), err.Error())
+		return err
+	}
+	return nil
+}
+
+// RemoveExpiredFile removes the file of an expired File message, unless other messages, e.g. forwards, reference it.
+func (manager *ConnectionManager) RemoveExpiredFile(expiry *dbmodels.MessageExpiry) error {
+	if expiry.FileID == nil {
+		return nil
+	}
+	return manager._releaseFile(*expiry.FileID, &dbmodels.MessageKey{
+		GroupID:       expiry.GroupID,
+		TimeCreated:   expiry.TimeCreated,
+		AccountinfoID: expiry.AccountinfoID,
+	})
+}
+
+// RemoveExpiredUpload removes the chunks left by an expired upload, whether it was abandoned, or committed while some
+// of its chunks could not be removed.
+func (manager *ConnectionManager) RemoveExpiredUpload(expiry *dbmodels.UploadExpiry) error {
+	return manager._removeUploadParts(expiry.ID, expiry.Parts)
+}
+
+// _prepareScheduledMessage builds a message to be sent at its send_at by the scheduler. The message is checked right
+// away, and again when it is sent.
+//
+// The scheduled message is not stored yet.
+func (manager *ConnectionManager) _prepareScheduledMessage(conn *connection.WSConnection, data *dbmodels.MessagePOST) (*dbmodels.ScheduledMessage, error) {
+	sendAt := data.SendAt.UTC().Truncate(time.Millisecond)
+	if !sendAt.After(time.Now()) || time.Until(sendAt) > message.ScheduleMaxDelay {
+		return nil, errors.New("send_at must be in the future, and within a year")
+	}
+	if _, err := manager._prepareNewMessage(conn.ClientID, conn.ClientName, data, sendAt); err != nil {
+		return nil, err
+	}
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return &dbmodels.ScheduledMessage{
+		SendAt:          sendAt,
+		ID:              gocql.TimeUUID(),
+		AccountinfoID:   conn.ClientID,
+		AccountinfoName: conn.ClientName,
+		GroupID:         data.GroupID,
+		Data:            string(encodedData),
+		Status:          dbmodels.DBScheduledStatus[0],
+		TimeCreated:     time.Now().UTC(),
+		Message:         data,
+	}, nil
+}
+
+// _decodeScheduledMessage decodes the input of a scheduled message, to send it back to the client.
+func (manager *ConnectionManager) _decodeScheduledMessage(scheduled *dbmodels.ScheduledMessage) error {
+	scheduled.Message = &dbmodels.MessagePOST{}
+	return json.Unmarshal([]byte(scheduled.Data), scheduled.Message)
+}
+
+// SendScheduledMessage stores and delivers a scheduled message, as if its sender sent it at its send_at.
+//
+// The message gets its send_at as creation time, so sending it again after a failure overwrites the same message.
+func (manager *ConnectionManager) SendScheduledMessage(scheduled *dbmodels.ScheduledMessage) error {
+	data := dbmodels.MessagePOST{}
+	if err := json.Unmarshal([]byte(scheduled.Data), &data); err != nil {
+		return err
+	}
+	newMessage, err := manager._prepareNewMessage(scheduled.AccountinfoID, scheduled.AccountinfoName, &data, scheduled.SendAt)
+	if err != nil {
+		return err
+	}
+	return manager._addNewMessage(newMessage)
+}
+
+// RemoveExpiredUnreadCount decrements the unread count incremented by an expired notification, and sends the new count
+// to the connections of the account on this instance.
+func (manager *ConnectionManager) RemoveExpiredUnreadCount(expiry *dbmodels.UnreadExpiry) error {
+	decremented, err := handler.NewNotificationHandler(manager.db).RemoveExpiredUnreadCount(expiry)
+	if err != nil {
+		return err
+	}
+	if decremented {
+		manager._sendUnreadCounts([]int{expiry.AccountinfoID}, expiry.GroupID, expiry.Type)
+	}
+	return nil
+}
+
+// _scheduleExpiry stores the expiry of an ephemeral message, for the scheduler to tell the online participants to drop
+// it when it expires (see SendMessageExpiry).
+//
+// Scylla removes the message by itself, the expiry only exists for the clients.
+func (manager *ConnectionManager) _scheduleExpiry(messageDB *dbmodels.Message) {
+	if messageDB.TimeExpired == nil {
+		return
+	}
+	// without an expiry event, clients still drop the message past its "time_expired"
+	_ = handler.NewMessageExpiryHandler(manager.db).AddMessageExpiry(messageDB)
+}
+
+// SendMessageExpiry tells the online participants of a group that an ephemeral message expired.
+func (manager *ConnectionManager) SendMessageExpiry(expiry *dbmodels.MessageExpiry) {
+	expiredMessage := dbmodels.Message{
+		GroupID:       expiry.GroupID,
+		TimeCreated:   expiry.TimeCreated,
+		AccountinfoID: expiry.AccountinfoID,
+		Deleted:       true,
+		TimeExpired:   &expiry.TimeExpired,
+	}
+	manager._sendMessageUpdate(&expiredMessage, message.MsgStatusDeleted)
+}
+
+// _sendNotificationsForNewMessage notifies the participants of a new message, except its sender and the participants
+// who turned off or muted the notifications of the group.
+func (manager *ConnectionManager) _sendNotificationsForNewMessage(messageDB *dbmodels.Message, participants []dbmodels.Participant) {
+	// mentioned participants get a mention instead, even if they muted the group
+	mentionedIDs := make([]int, 0)
+	for _, participant := range participants {
+		if participant.AccountinfoID != messageDB.AccountinfoID && (messageDB.MentionAll || slices.Contains(messageDB.Mentions, participant.AccountinfoID)) {
+			mentionedIDs = append(mentionedIDs, participant.AccountinfoID)
+		}
+	}
+	notifiedIDs := manager._getNotifiedIDs(messageDB.GroupID, participants, messageDB.AccountinfoID)
+	// the author of the replied message gets a reply instead, unless already mentioned
+	replyToID := 0
+	if parent := messageDB.ReplyTo(); parent != nil && slices.Contains(notifiedIDs, parent.AccountinfoID) &&
+		!slices.Contains(mentionedIDs, parent.AccountinfoID) {
+		replyToID = parent.AccountinfoID
+	}
+	listID := slices.DeleteFunc(notifiedIDs, func(id int) bool {
+		return id == replyToID || slices.Contains(mentionedIDs, id)
+	})
+	notification := dbmodels.Notification{
+		AccountinfoID:       0, // iterated later
+		Type:                dbmodels.DBNotificationType[0],
+		GroupID:             messageDB.GroupID,
+		AccountinfoIDSender: messageDB.AccountinfoID,
+		Content:             messageDB.AccountinfoName + ": " + messageDB.Content,
+		TimeCreated:         messageDB.TimeCreated.UTC(),
+		TimeExpired:         messageDB.TimeExpired,
+	}
+	manager._sendNotifications(listID, &notification)
+
+	if len(mentionedIDs) > 0 {
+		mentionNotification := notification
+		mentionNotification.Type = dbmodels.DBNotificationType[3]
+		mentionNotification.Content = messageDB.AccountinfoName + " mentioned you: " + messageDB.Content
+		manager._sendNotifications(mentionedIDs, &mentionNotification)
+	}
+
+	if replyToID != 0 {
+		replyNotification := notification
+		replyNotification.Type = dbmodels.DBNotificationType[2]
+		replyNotification.Content = messageDB.AccountinfoName + " replied: " + messageDB.Content
+		manager._sendNotifications([]int{replyToID}, &replyNotification)
+	}
+}
+
+// _loadMessageDetails loads what is not stored with the messages: their reactions, and the polls of Poll messages.
+//
+// The messages are loaded concurrently, up to messageDetailsConcurrency at once.
+func (manager *ConnectionManager) _loadMessageDetails(messages []dbmodels.Message) error {
+	reactionHandler := handler.NewReactionHandler(manager.db)
+	pollHandler := handler.NewPollHandler(manager.db)
+	errs := make([]error, len(messages))
+	semaphore := make(chan struct{}, messageDetailsConcurrency)
+	var wg sync.WaitGroup
+	for i := range messages {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(m *dbmodels.Message, err *error) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			m.Reactions, *err = reactionHandler.GetReactionSummary(m.Key())
+			if *err == nil && m.Type == dbmodels.DBMessageType[2] && !m.Deleted {
+				m.Poll, *err = pollHandler.GetPoll(m.Key())
+			}
+		}(&messages[i], &errs[i])
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// _sendPinNotifications notifies the participants of a group that one of its messages was pinned.
+func (manager *ConnectionManager) _sendPinNotifications(messageDB *dbmodels.Message, pinner *connection.WSConnection) {
+	participants, err := handler.NewParticipantHandler(manager.db).GetAllParticipantsFromGroup(messageDB.GroupID)
+	if err != nil {
+		fmt.Println("Error getting all participants:", err.Error())
+		return
+	}
+	notification := dbmodels.Notification{
+		Type:                dbmodels.DBNotificationType[0],
+		GroupID:             messageDB.GroupID,
+		AccountinfoIDSender: pinner.ClientID,
+		Content:             pinner.ClientName + " pinned a message: " + messageDB.Content,
+		TimeCreated:         time.Now().UTC(),
+		TimeExpired:         messageDB.TimeExpired,
+	}
+	manager._sendNotifications(manager._getNotifiedIDs(messageDB.GroupID, participants, pinner.ClientID), &notification)
+}
+
+// _getNotifiedIDs returns the participants who get the notifications of a group, except the sender and the
+// participants who turned off or muted the notifications of the group.
+func (manager *ConnectionManager) _getNotifiedIDs(groupID gocql.UUID, participants []dbmodels.Participant, senderID int) []int {
+	mutedIDs, err := handler.NewParticipantHandler(manager.db).GetAllMutedIDsFromGroup(groupID)
+	if err != nil {
+		fmt.Println("Error getting muted participants:", err.Error())
+	}
+	listID := make([]int, 0, len(participants))
+	for _, participant := range participants {
+		if participant.AccountinfoID != senderID && participant.Notify && !slices.Contains(mutedIDs, participant.AccountinfoID) {
+			listID = append(listID, participant.AccountinfoID)
+		}
+	}
+	return listID
+}
+
+// _sendNotifications stores a notification for each client, then sends it with their new unread count.
+func (manager *ConnectionManager) _sendNotifications(clientIDs []int, notification *dbmodels.Notification) {
+	if len(clientIDs) == 0 {
+		return
+	}
 	// add notification to database
-	notificationHandler := handler.NewNotificationHandler(manager.db)
-	notificationHandler.AddMultipleNotifications(listID, &notification)
+	handler.NewNotificationHandler(manager.db).AddMultipleNotifications(clientIDs, notification)
 	// send notification to clients
 	notificationMsg := message.NewOutputMessage(message.MsgTypeNotification, message.MsgStatusNew, "")
-	notificationMsg.Notification = &notification
-	manager.SendToClients(listID, notificationMsg)
+	notificationMsg.Notification = notification
+	manager.SendToClients(clientIDs, notificationMsg)
+	manager._sendUnreadCounts(clientIDs, notification.GroupID, notification.Type)
+}
+
+// _sendUnreadCounts sends the current unread count of a group and notification type to the clients.
+//
+// Clients without any session are skipped, they get every count in the summary when they connect.
+func (manager *ConnectionManager) _sendUnreadCounts(clientIDs []int, groupID gocql.UUID, notificationType string) {
+	notificationHandler := handler.NewNotificationHandler(manager.db)
+	for _, clientID := range clientIDs {
+		if len(manager.sessions.GetByClient(clientID)) == 0 {
+			continue
+		}
+		unreadCount, err := notificationHandler.GetUnreadCount(clientID, groupID, notificationType)
+		if err != nil {
+			continue
+		}
+		unreadMsg := message.NewOutputMessage(message.MsgTypeUnreadSummary, message.MsgStatusUpdated, "")
+		unreadMsg.Unread = []dbmodels.UnreadCount{*unreadCount}
+		manager.SendToClient(clientID, unreadMsg)
+	}
+}
+
+// _sendUnreadSummary sends every non-zero unread count of the client to the session of the connection.
+func (manager *ConnectionManager) _sendUnreadSummary(c *connection.WSConnection) {
+	unreadCounts, err := handler.NewNotificationHandler(manager.db).GetAllUnreadCounts(c.ClientID)
+	if err != nil {
+		return
+	}
+	unreadMsg := message.NewOutputMessage(message.MsgTypeUnreadSummary, message.MsgStatusNew, "")
+	unreadMsg.Unread = slices.DeleteFunc(unreadCounts, func(unreadCount dbmodels.UnreadCount) bool { return unreadCount.Count == 0 })
+	c.Session.Append(unreadMsg)
+}
+
+// _setMentions sets the participants mentioned by a text message. Only admins can mention everyone with "@all".
+func (manager *ConnectionManager) _setMentions(messageDB *dbmodels.Message, sender *dbmodels.Participant) error {
+	messageDB.Mentions = nil
+	messageDB.MentionAll = false
+	if messageDB.Type != dbmodels.DBMessageType[0] {
+		return nil
+	}
+	ids, all := message.ParseMentions(messageDB.Content)
+	messageDB.MentionAll = all && sender.Role == conf.PARTICIPANT_ROLE_ADMIN
+	if len(ids) == 0 || messageDB.MentionAll {
+		return nil
+	}
+	participantIDs, err := handler.NewParticipantHandler(manager.db).GetAllParticipantIDsFromGroup(messageDB.GroupID)
+	if err != nil {
+		return err
+	}
+	// mentions of accounts outside the group, or of the sender, are plain text
+	for _, id := range ids {
+		if id != messageDB.AccountinfoID && slices.Contains(participantIDs, id) {
+			messageDB.Mentions = append(messageDB.Mentions, id)
+		}
+	}
+	return nil
+}
+
+// _relayTyping tells the other online participants of the group that the client started or stopped typing.
+//
+// Typing events are not stored anywhere, not even in the sessions.
+func (manager *ConnectionManager) _relayTyping(groupID gocql.UUID, clientID int, status string) {
+	listID, err := handler.NewParticipantHandler(manager.db).GetAllParticipantIDsFromGroup(groupID)
+	if err != nil {
+		fmt.Println("Error getting all participants:", err.Error())
+		return
+	}
+	typingMsg := message.NewOutputMessage(message.MsgTypeTyping, status, "")
+	typingMsg.Typing = &message.TypingEvent{GroupID: groupID, AccountinfoID: clientID}
+	manager._sendEphemeralToClients(slices.DeleteFunc(listID, func(id int) bool { return id == clientID }), typingMsg)
+}
+
+// _getContactIDs returns the accounts sharing at least one group with the client.
+func (manager *ConnectionManager) _getContactIDs(clientID int) ([]int, error) {
+	participantHandler := handler.NewParticipantHandler(manager.db)
+	groupIDs, err := participantHandler.GetAllGroupIDsFromAccount(clientID)
+	if err != nil {
+		return nil, err
+	}
+	contactIDs := make([]int, 0)
+	for _, groupID := range groupIDs {
+		participantIDs, err := participantHandler.GetAllParticipantIDsFromGroup(groupID)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range participantIDs {
+			if id != clientID && !slices.Contains(contactIDs, id) {
+				contactIDs = append(contactIDs, id)
+			}
+		}
+	}
+	return contactIDs, nil
+}
+
+// _sendPresence tells the online clients sharing a group with the client that it went online or offline.
+func (manager *ConnectionManager) _sendPresence(clientID int, online bool) {
+	participantHandler := handler.NewParticipantHandler(manager.db)
+	groupIDs, err := participantHandler.GetAllGroupIDsFromAccount(clientID)
+	if err != nil {
+		fmt.Println("Error getting all groups:", err.Error())
+		return
+	}
+	// the same client can share several groups with the changed one
+	sharedGroupIDs := make(map[int][]gocql.UUID)
+	for _, groupID := range groupIDs {
+		participantIDs, err := participantHandler.GetAllParticipantIDsFromGroup(groupID)
+		if err != nil {
+			fmt.Println("Error getting all participants:", err.Error())
+			continue
+		}
+		for _, id := range participantIDs {
+			if id != clientID {
+				sharedGroupIDs[id] = append(sharedGroupIDs[id], groupID)
+			}
+		}
+	}
+	status := message.MsgStatusOffline
+	if online {
+		status = message.MsgStatusOnline
+	}
+	presenceMsg := message.NewOutputMessage(message.MsgTypePresence, status, "")
+	presenceMsg.Presence = []message.PresenceStatus{{AccountinfoID: clientID, Online: online}}
+	// only the connections viewing one of the shared groups care about it
+	for id, shared := range sharedGroupIDs {
+		for _, conn := range manager._getConnectionsMutex(id) {
+			if !conn.IsViewing(shared...) {
+				continue
+			}
+			manager.MessageSentCounter.WithLabelValues(presenceMsg.Type).Inc()
+			if err := conn.WriteJSONMessage(presenceMsg); err != nil {
+				fmt.Println("Error sending message to client:", err.Error())
+			}
+		}
+	}
 }
 
 func (manager *ConnectionManager) GetAllConnections() {
 	fmt.Println("All connections:", manager.connectionsByID)
 }
 
-func (manager *ConnectionManager) ProcessInputMessage(conn *connection.WSConnection, msg *message.InputMessage) error {
+// ProcessInputMessage handles a message from a client and returns the success response to send back.
+func (manager *ConnectionManager) ProcessInputMessage(conn *connection.WSConnection, msg *message.InputMessage) (*message.OutputMessage, error) {
+	response := message.NewOutputMessage(message.MsgTypeResponse, message.MsgStatusSuccess, "")
 	switch msg.Type {
 	case message.MsgTypeMessageNew:
 		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeMessageNew).Inc()
-		groupHandler := handler.NewGroupHandler(manager.db)
-		participantHandler := handler.NewParticipantHandler(manager.db)
-		group, err := groupHandler.GetGroupByID(msg.Data.GroupID)
-		if err != nil || group == nil {
-			return errors.New("group not found")
+		// a message with a send_at is sent later by the scheduler
+		var newMessage *dbmodels.Message
+		var scheduled *dbmodels.ScheduledMessage
+		var err error
+		if msg.Data.SendAt != nil {
+			scheduled, err = manager._prepareScheduledMessage(conn, msg.Data)
+		} else {
+			newMessage, err = manager._prepareNewMessage(conn.ClientID, conn.ClientName, msg.Data, time.Now())
+		}
+		if err != nil {
+			return nil, err
+		}
+		messageHandler := handler.NewMessageHandler(manager.db)
+		var dedupe *dbmodels.MessageDedupe
+		if msg.Data.ClientMessageID != nil {
+			dedupe = &dbmodels.MessageDedupe{
+				AccountinfoID:   conn.ClientID,
+				ClientMessageID: *msg.Data.ClientMessageID,
+				GroupID:         msg.Data.GroupID,
+			}
+			if scheduled != nil {
+				// the scheduled message gets its send_at as creation time
+				dedupe.TimeCreated = scheduled.SendAt
+				dedupe.ScheduledID = &scheduled.ID
+			} else {
+				dedupe.TimeCreated = newMessage.TimeCreated
+			}
+			original, reserved, err := messageHandler.ReserveClientMessageID(dedupe)
+			if err != nil {
+				return nil, err
+			}
+			if !reserved && original.ScheduledID != nil {
+				// the client is retrying a message that was already scheduled, return the original result
+				originalScheduled, err := handler.NewScheduledMessageHandler(manager.db).GetScheduledMessage(original.TimeCreated, *original.ScheduledID)
+				if err != nil || manager._decodeScheduledMessage(originalScheduled) != nil {
+					return nil, errors.New("message with this client_message_id is still being processed")
+				}
+				response.EntityID = originalScheduled.ID.String()
+				response.Scheduled = []dbmodels.ScheduledMessage{*originalScheduled}
+				return response, nil
+			}
+			if !reserved {
+				// the client is retrying a message that was already sent, return the original result
+				originalMessage, err := messageHandler.GetMessage(original.GroupID, original.TimeCreated, conn.ClientID)
+				if err != nil {
+					return nil, errors.New("message with this client_message_id is still being processed")
+				}
+				response.EntityID = originalMessage.TimeCreated.Format(time.RFC3339Nano)
+				response.Message = originalMessage
+				return response, nil
+			}
+		}
+		if scheduled != nil {
+			if err := handler.NewScheduledMessageHandler(manager.db).AddScheduledMessage(scheduled); err != nil {
+				if dedupe != nil {
+					_ = messageHandler.RemoveClientMessageID(dedupe)
+				}
+				return nil, err
+			}
+			if dedupe != nil {
+				_ = messageHandler.ConfirmClientMessageID(dedupe)
+			}
+			response.EntityID = scheduled.ID.String()
+			response.Scheduled = []dbmodels.ScheduledMessage{*scheduled}
+			return response, nil
+		}
+		if manager.typing.Stop(newMessage.GroupID, conn.ClientID) {
+			manager._relayTyping(newMessage.GroupID, conn.ClientID, message.MsgStatusStop)
+		}
+		if err := manager._addNewMessage(newMessage); err != nil {
+			if dedupe != nil {
+				_ = messageHandler.RemoveClientMessageID(dedupe)
+			}
+			return nil, err
 		}
-		participant, err := participantHandler.CheckJoinedParticipant(conn.ClientID, group.ID)
+		if dedupe != nil {
+			_ = messageHandler.ConfirmClientMessageID(dedupe)
+		}
+		// the message is identified by its creation time within the group and sender
+		response.EntityID = newMessage.TimeCreated.Format(time.RFC3339Nano)
+		response.Message = newMessage
+		return response, nil
+
+	case message.MsgTypeMessageForward:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeMessageForward).Inc()
+		target := msg.Data.Target
+		target.TimeCreated = target.TimeCreated.UTC()
+		participant, err := handler.NewParticipantHandler(manager.db).CheckJoinedParticipant(conn.ClientID, target.GroupID)
 		if err != nil || participant == nil {
-			return errors.New("not a participant of this group")
+			return nil, errors.New("not a participant of this group")
+		}
+		source, err := handler.NewMessageHandler(manager.db).GetMessage(target.GroupID, target.TimeCreated, target.AccountinfoID)
+		if err != nil || source.Deleted {
+			return nil, errors.New("message not found")
+		}
+		// a poll belongs to its group, its votes cannot follow it
+		if source.Type != dbmodels.DBMessageType[0] && source.Type != dbmodels.DBMessageType[1] {
+			return nil, errors.New("only messages and files can be forwarded")
 		}
-		newMessage := dbmodels.Message{
-			AccountinfoID:   conn.ClientID,
-			GroupID:         msg.Data.GroupID,
-			Content:         msg.Data.Content,
-			TimeCreated:     time.Now().UTC(),
-			Type:            msg.Data.Type,
-			AccountinfoName: conn.ClientName,
-			GroupName:       group.Name,
+		// a forwarded message keeps pointing at the original message
+		original := source.ForwardedFrom()
+		if original == nil {
+			original = source.Key()
 		}
-		err = handler.NewMessageHandler(manager.db).AddNewMessage(&newMessage)
+		// every target group is checked before anything is sent
+		timeCreated := time.Now()
+		var forwarded []*dbmodels.Message
+		for _, groupID := range msg.Data.GroupIDs {
+			if slices.ContainsFunc(forwarded, func(m *dbmodels.Message) bool { return m.GroupID == groupID }) {
+				continue
+			}
+			newMessage, err := manager._prepareNewMessage(conn.ClientID, conn.ClientName, &dbmodels.MessagePOST{
+				GroupID: groupID,
+				Content: source.Content,
+				Type:    source.Type,
+			}, timeCreated)
+			if err != nil {
+				return nil, fmt.Errorf("cannot forward to group %s: %w", groupID.String(), err)
+			}
+			// the mentions were meant for the original group
+			newMessage.Mentions = nil
+			newMessage.MentionAll = false
+			newMessage.ForwardedGroupID = &original.GroupID
+			newMessage.ForwardedTimeCreated = &original.TimeCreated
+			newMessage.ForwardedAccountinfoID = &original.AccountinfoID
+			// the forwarded message shares the uploaded file, if any
+			newMessage.FileID = source.FileID
+			newMessage.FileSize = source.FileSize
+			newMessage.FileMime = source.FileMime
+			// an ephemeral message stays ephemeral, it cannot outlive the original
+			if source.TimeExpired != nil && (newMessage.TimeExpired == nil || source.TimeExpired.Before(*newMessage.TimeExpired)) {
+				newMessage.TimeExpired = source.TimeExpired
+			}
+			forwarded = append(forwarded, newMessage)
+		}
+		for _, newMessage := range forwarded {
+			if err := manager._addNewMessage(newMessage); err != nil {
+				// the messages sent to the previous groups stay, tell the client which ones they are
+				response.Status = message.MsgStatusError
+				response.Content = fmt.Sprintf("cannot forward to group %s: %s", newMessage.GroupID.String(), err.Error())
+				return response, nil
+			}
+			response.Messages = append(response.Messages, *newMessage)
+		}
+		return response, nil
+
+	case message.MsgTypeUploadBegin:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeUploadBegin).Inc()
+		if msg.Data.UploadID != nil {
+			upload, err := manager._getUpload(conn.ClientID, *msg.Data.UploadID)
+			if err != nil {
+				return nil, err
+			}
+			response.EntityID = upload.ID.String()
+			response.Upload = upload
+			return response, nil
+		}
+		participant, err := handler.NewParticipantHandler(manager.db).CheckJoinedParticipant(conn.ClientID, msg.Data.GroupID)
+		if err != nil || participant == nil {
+			return nil, errors.New("not a participant of this group")
+		}
+		upload := dbmodels.FileUpload{
+			ID:            gocql.TimeUUID(),
+			AccountinfoID: conn.ClientID,
+			GroupID:       msg.Data.GroupID,
+			Filename:      msg.Data.Content,
+			FileSize:      msg.Data.FileSize,
+			FileMime:      msg.Data.FileMime,
+			Checksum:      strings.ToLower(msg.Data.Checksum),
+			ChunkSize:     conf.UPLOAD_CHUNK_SIZE,
+			Status:        dbmodels.DBUploadStatus[0],
+			TimeCreated:   time.Now().UTC(),
+		}
+		if upload.FileMime == "" {
+			upload.FileMime = "application/octet-stream"
+		}
+		if err := handler.NewFileUploadHandler(manager.db).AddUpload(&upload); err != nil {
+			return nil, err
+		}
+		response.EntityID = upload.ID.String()
+		response.Upload = &upload
+		return response, nil
+
+	case message.MsgTypeUploadChunk:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeUploadChunk).Inc()
+		upload, err := manager._getUpload(conn.ClientID, *msg.Data.UploadID)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		manager._sendNotificationsForNewMessage(&newMessage, nil)
-		return nil
+		if upload.Status != dbmodels.DBUploadStatus[0] {
+			return nil, errors.New("the upload is already committed")
+		}
+		offset, size := msg.Data.Offset, int64(len(msg.Data.Chunk))
+		response.EntityID = upload.ID.String()
+		response.Upload = upload
+		if offset+size <= upload.Received && offset%int64(upload.ChunkSize) == 0 {
+			// the client is retrying a chunk which was already stored
+			return response, nil
+		}
+		if offset != upload.Received {
+			return nil, fmt.Errorf("unexpected offset %d, the upload continues at offset %d", offset, upload.Received)
+		}
+		if offset+size > upload.FileSize || (size != int64(upload.ChunkSize) && offset+size != upload.FileSize) {
+			return nil, fmt.Errorf("chunks must have %d bytes, except the last one, for a total of %d bytes", upload.ChunkSize, upload.FileSize)
+		}
+		sum := sha256.Sum256(msg.Data.Chunk)
+		if hex.EncodeToString(sum[:]) != strings.ToLower(msg.Data.Checksum) {
+			return nil, errors.New("chunk checksum mismatch")
+		}
+		partKey := storage.PartKey(upload.ID.String(), offset/int64(upload.ChunkSize))
+		if err := manager.store.Put(context.Background(), partKey, bytes.NewReader(msg.Data.Chunk), size, "application/octet-stream"); err != nil {
+			return nil, err
+		}
+		stored, err := handler.NewFileUploadHandler(manager.db).SetUploadReceived(upload, offset+size)
+		if err != nil {
+			return nil, err
+		}
+		if !stored {
+			return nil, fmt.Errorf("the upload changed meanwhile, it continues at offset %d", upload.Received)
+		}
+		return response, nil
+
+	case message.MsgTypeUploadCommit:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeUploadCommit).Inc()
+		uploadHandler := handler.NewFileUploadHandler(manager.db)
+		upload, err := manager._getUpload(conn.ClientID, *msg.Data.UploadID)
+		if err != nil {
+			return nil, err
+		}
+		switch upload.Status {
+		case dbmodels.DBUploadStatus[1]:
+			// the instance which claimed the upload did not finish in time, it probably stopped
+			if upload.TimeClaimed != nil && time.Since(*upload.TimeClaimed) < conf.UPLOAD_COMMIT_TIMEOUT {
+				return nil, errors.New("the upload is being committed")
+			}
+		case dbmodels.DBUploadStatus[2]:
+			// the client is retrying a commit which succeeded, return the original result
+			fileMessage, err := handler.NewMessageHandler(manager.db).GetMessage(upload.GroupID, *upload.MessageTimeCreated, upload.AccountinfoID)
+			if err != nil {
+				return nil, errors.New("message not found")
+			}
+			response.EntityID = fileMessage.TimeCreated.Format(time.RFC3339Nano)
+			response.Message = fileMessage
+			return response, nil
+		}
+		if upload.Received != upload.FileSize {
+			return nil, fmt.Errorf("the upload is incomplete, %d of %d bytes received", upload.Received, upload.FileSize)
+		}
+		newMessage, err := manager._prepareNewMessage(conn.ClientID, conn.ClientName, &dbmodels.MessagePOST{
+			GroupID:   upload.GroupID,
+			Content:   upload.Filename,
+			Type:      dbmodels.DBMessageType[1],
+			ReplyTo:   msg.Data.ReplyTo,
+			ExpiresIn: msg.Data.ExpiresIn,
+		}, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		claimed, err := uploadHandler.SetUploadStatus(upload, dbmodels.DBUploadStatus[1])
+		if err != nil {
+			return nil, err
+		}
+		if !claimed {
+			return nil, errors.New("the upload is being committed")
+		}
+		newMessage.FileID = &upload.ID
+		newMessage.FileSize = &upload.FileSize
+		newMessage.FileMime = &upload.FileMime
+		if err := manager._assembleUpload(upload); err != nil {
+			// the chunks are still there, the commit can be retried
+			_, _ = uploadHandler.SetUploadStatus(upload, dbmodels.DBUploadStatus[0])
+			return nil, err
+		}
+		if err := manager._addNewMessage(newMessage); err != nil {
+			_, _ = uploadHandler.SetUploadStatus(upload, dbmodels.DBUploadStatus[0])
+			return nil, err
+		}
+		upload.MessageTimeCreated = &newMessage.TimeCreated
+		_, _ = uploadHandler.SetUploadStatus(upload, dbmodels.DBUploadStatus[2])
+		// chunks left over are removed once the upload expired
+		go manager._removeUploadParts(upload.ID, (upload.FileSize+int64(upload.ChunkSize)-1)/int64(upload.ChunkSize))
+		response.EntityID = newMessage.TimeCreated.Format(time.RFC3339Nano)
+		response.Message = newMessage
+		return response, nil
+
+	case message.MsgTypeScheduledList:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeScheduledList).Inc()
+		scheduled, err := handler.NewScheduledMessageHandler(manager.db).GetAllScheduledMessagesFromAccount(conn.ClientID)
+		if err != nil {
+			return nil, err
+		}
+		// messages being sent right now are about to leave the list
+		scheduled = slices.DeleteFunc(scheduled, func(s dbmodels.ScheduledMessage) bool { return s.Status != dbmodels.DBScheduledStatus[0] })
+		for i := range scheduled {
+			if err := manager._decodeScheduledMessage(&scheduled[i]); err != nil {
+				return nil, err
+			}
+		}
+		response.Scheduled = scheduled
+		return response, nil
+
+	case message.MsgTypeScheduledCancel:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeScheduledCancel).Inc()
+		scheduledHandler := handler.NewScheduledMessageHandler(manager.db)
+		scheduled, err := scheduledHandler.GetScheduledMessage(msg.Data.SendAt.UTC(), *msg.Data.ScheduledID)
+		if err != nil || scheduled.AccountinfoID != conn.ClientID {
+			return nil, errors.New("scheduled message not found")
+		}
+		if scheduled.Status != dbmodels.DBScheduledStatus[0] {
+			return nil, errors.New("the message is already " + strings.ToLower(scheduled.Status))
+		}
+		canceled, err := scheduledHandler.SetScheduledMessageStatus(scheduled, dbmodels.DBScheduledStatus[3])
+		if err != nil {
+			return nil, err
+		}
+		if !canceled {
+			return nil, errors.New("the message is already being sent")
+		}
+		_ = scheduledHandler.RemoveScheduledMessageFromAccount(scheduled)
+		response.EntityID = scheduled.ID.String()
+		return response, nil
 
 	case message.MsgTypeNotificationRead:
 		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeNotificationRead).Inc()
@@ -181,13 +1065,546 @@ func (manager *ConnectionManager) ProcessInputMessage(conn *connection.WSConnect
 			GroupID:       msg.Data.GroupID,
 			TimeCreated:   time.Now().UTC(),
 		}
-		err := handler.NewNotificationHandler(manager.db).AddNotificationSeen(&notificationSeen)
+		notificationHandler := handler.NewNotificationHandler(manager.db)
+		err := notificationHandler.AddNotificationSeen(&notificationSeen)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return nil
+		err = notificationHandler.ResetUnreadCount(conn.ClientID, msg.Data.GroupID, msg.Data.Type)
+		if err != nil {
+			return nil, err
+		}
+		// the other connections of the client update their counts too
+		manager._sendUnreadCounts([]int{conn.ClientID}, msg.Data.GroupID, msg.Data.Type)
+		return response, nil
+
+	case message.MsgTypeGroupMute:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeGroupMute).Inc()
+		participantHandler := handler.NewParticipantHandler(manager.db)
+		participant, err := participantHandler.CheckJoinedParticipant(conn.ClientID, msg.Data.GroupID)
+		if err != nil || participant == nil {
+			return nil, errors.New("not a participant of this group")
+		}
+		// without an end, the notifications of the group are turned off until unmuted
+		if msg.Data.MuteUntil == nil {
+			if err := participantHandler.SetParticipantNotify(participant, false); err != nil {
+				return nil, err
+			}
+			return response, nil
+		}
+		muteUntil := msg.Data.MuteUntil.UTC()
+		if !muteUntil.After(time.Now()) || time.Until(muteUntil) > message.MuteMaxDuration {
+			return nil, errors.New("mute_until must be in the future, and within a year")
+		}
+		err = participantHandler.MuteParticipant(&dbmodels.ParticipantMute{
+			GroupID:       participant.GroupID,
+			AccountinfoID: conn.ClientID,
+			MuteUntil:     muteUntil,
+			TimeCreated:   time.Now().UTC(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return response, nil
+
+	case message.MsgTypeGroupUnmute:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeGroupUnmute).Inc()
+		participantHandler := handler.NewParticipantHandler(manager.db)
+		participant, err := participantHandler.CheckJoinedParticipant(conn.ClientID, msg.Data.GroupID)
+		if err != nil || participant == nil {
+			return nil, errors.New("not a participant of this group")
+		}
+		if !participant.Notify {
+			if err := participantHandler.SetParticipantNotify(participant, true); err != nil {
+				return nil, err
+			}
+		}
+		if err := participantHandler.UnmuteParticipant(participant.GroupID, conn.ClientID); err != nil {
+			return nil, err
+		}
+		return response, nil
+
+	case message.MsgTypeGroupFocus:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeGroupFocus).Inc()
+		participantHandler := handler.NewParticipantHandler(manager.db)
+		for _, groupID := range msg.Data.GroupIDs {
+			participant, err := participantHandler.CheckJoinedParticipant(conn.ClientID, groupID)
+			if err != nil || participant == nil {
+				return nil, errors.New("not a participant of group " + groupID.String())
+			}
+		}
+		conn.SetActiveGroups(msg.Data.GroupIDs)
+		return response, nil
+
+	case message.MsgTypeGroupRetention:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeGroupRetention).Inc()
+		participant, err := handler.NewParticipantHandler(manager.db).CheckJoinedParticipant(conn.ClientID, msg.Data.GroupID)
+		if err != nil || participant == nil {
+			return nil, errors.New("not a participant of this group")
+		}
+		if participant.Role != conf.PARTICIPANT_ROLE_ADMIN {
+			return nil, errors.New("only a group admin can change the retention")
+		}
+		// existing messages keep their expiry
+		err = handler.NewGroupHandler(manager.db).SetGroupSetting(&dbmodels.GroupSetting{
+			GroupID:     participant.GroupID,
+			MessageTTL:  msg.Data.ExpiresIn,
+			TimeCreated: time.Now().UTC(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return response, nil
+
+	case message.MsgTypeNotificationList:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeNotificationList).Inc()
+		pageState, err := base64.URLEncoding.DecodeString(msg.Data.Cursor)
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+		notifications, nextPageState, err := handler.NewNotificationHandler(manager.db).GetNotifications(conn.ClientID, msg.Data.Type, pageState, msg.Data.Limit)
+		if err != nil {
+			return nil, err
+		}
+		response.Notifications = notifications
+		response.Cursor = base64.URLEncoding.EncodeToString(nextPageState)
+		return response, nil
+
+	case message.MsgTypeNotificationReadAll:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeNotificationReadAll).Inc()
+		groupIDs, err := handler.NewParticipantHandler(manager.db).GetAllGroupIDsFromAccount(conn.ClientID)
+		if err != nil {
+			return nil, err
+		}
+		notificationHandler := handler.NewNotificationHandler(manager.db)
+		unreadCounts, err := notificationHandler.GetAllUnreadCounts(conn.ClientID)
+		if err != nil {
+			return nil, err
+		}
+		// the account can still have unread notifications of groups it left
+		for _, unreadCount := range unreadCounts {
+			if !slices.Contains(groupIDs, unreadCount.GroupID) {
+				groupIDs = append(groupIDs, unreadCount.GroupID)
+			}
+		}
+		err = notificationHandler.AddAllNotificationsSeen(conn.ClientID, groupIDs, dbmodels.DBNotificationType, time.Now().UTC())
+		if err != nil {
+			return nil, err
+		}
+		resetCounts := make([]dbmodels.UnreadCount, 0)
+		for _, unreadCount := range unreadCounts {
+			if unreadCount.Count == 0 {
+				continue
+			}
+			if err := notificationHandler.ResetUnreadCount(conn.ClientID, unreadCount.GroupID, unreadCount.Type); err != nil {
+				return nil, err
+			}
+			unreadCount.Count = 0
+			resetCounts = append(resetCounts, unreadCount)
+		}
+		if len(resetCounts) > 0 {
+			unreadMsg := message.NewOutputMessage(message.MsgTypeUnreadSummary, message.MsgStatusUpdated, "")
+			unreadMsg.Unread = resetCounts
+			manager.SendToClient(conn.ClientID, unreadMsg)
+		}
+		return response, nil
+
+	case message.MsgTypeMessageHistory:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeMessageHistory).Inc()
+		participant, err := handler.NewParticipantHandler(manager.db).CheckJoinedParticipant(conn.ClientID, msg.Data.GroupID)
+		if err != nil || participant == nil {
+			return nil, errors.New("not a participant of this group")
+		}
+		pageState, err := base64.URLEncoding.DecodeString(msg.Data.Cursor)
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+		messages, nextPageState, err := handler.NewMessageHandler(manager.db).GetMessagesFromGroup(msg.Data.GroupID, pageState, msg.Data.Limit)
+		if err != nil {
+			return nil, err
+		}
+		if err := manager._loadMessageDetails(messages); err != nil {
+			return nil, err
+		}
+		response.Messages = messages
+		response.Cursor = base64.URLEncoding.EncodeToString(nextPageState)
+		return response, nil
+
+	case message.MsgTypeMessageThread:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeMessageThread).Inc()
+		target := msg.Data.Target
+		participant, err := handler.NewParticipantHandler(manager.db).CheckJoinedParticipant(conn.ClientID, target.GroupID)
+		if err != nil || participant == nil {
+			return nil, errors.New("not a participant of this group")
+		}
+		pageState, err := base64.URLEncoding.DecodeString(msg.Data.Cursor)
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+		target.TimeCreated = target.TimeCreated.UTC()
+		replies, nextPageState, err := handler.NewMessageHandler(manager.db).GetRepliesFromMessage(target, pageState, msg.Data.Limit)
+		if err != nil {
+			return nil, err
+		}
+		if err := manager._loadMessageDetails(replies); err != nil {
+			return nil, err
+		}
+		response.Target = target
+		response.Messages = replies
+		response.Cursor = base64.URLEncoding.EncodeToString(nextPageState)
+		return response, nil
+
+	case message.MsgTypeMessageEdit, message.MsgTypeMessageDelete:
+		manager.MessageReceivedCounter.WithLabelValues(msg.Type).Inc()
+		target := msg.Data.Target
+		participant, err := handler.NewParticipantHandler(manager.db).CheckJoinedParticipant(conn.ClientID, target.GroupID)
+		if err != nil || participant == nil {
+			return nil, errors.New("not a participant of this group")
+		}
+		messageHandler := handler.NewMessageHandler(manager.db)
+		targetMessage, err := messageHandler.GetMessage(target.GroupID, target.TimeCreated.UTC(), target.AccountinfoID)
+		if err != nil || targetMessage.Deleted {
+			return nil, errors.New("message not found")
+		}
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		targetMessage.TimeEdited = &now
+		status := message.MsgStatusEdited
+		if msg.Type == message.MsgTypeMessageEdit {
+			// only the author can put words in their own message
+			if targetMessage.AccountinfoID != conn.ClientID {
+				return nil, errors.New("only the author can edit this message")
+			}
+			if targetMessage.Type != dbmodels.DBMessageType[0] {
+				return nil, errors.New("only text messages can be edited")
+			}
+			targetMessage.Content = msg.Data.Content
+			// mentions follow the content, but are not notified again
+			if err := manager._setMentions(targetMessage, participant); err != nil {
+				return nil, err
+			}
+		} else {
+			if targetMessage.AccountinfoID != conn.ClientID && participant.Role != conf.PARTICIPANT_ROLE_ADMIN {
+				return nil, errors.New("only the author or a group admin can delete this message")
+			}
+			targetMessage.Content = ""
+			targetMessage.Mentions = nil
+			targetMessage.MentionAll = false
+			targetMessage.Deleted = true
+			status = message.MsgStatusDeleted
+		}
+		if err := messageHandler.UpdateMessage(targetMessage); err != nil {
+			return nil, err
+		}
+		if targetMessage.Deleted && targetMessage.TimeExpired != nil {
+			// the participants were already told that the message is gone
+			_ = handler.NewMessageExpiryHandler(manager.db).RemoveMessageExpiry(targetMessage)
+		}
+		if targetMessage.Deleted && targetMessage.FileID != nil {
+			// the message is deleted either way, a file left behind is only a leak
+			_ = manager._releaseFile(*targetMessage.FileID, targetMessage.Key())
+		}
+		manager._sendMessageUpdate(targetMessage, status)
+		response.EntityID = targetMessage.TimeCreated.Format(time.RFC3339Nano)
+		response.Message = targetMessage
+		return response, nil
+
+	case message.MsgTypePollVote:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypePollVote).Inc()
+		target := msg.Data.Target
+		target.TimeCreated = target.TimeCreated.UTC()
+		participant, err := handler.NewParticipantHandler(manager.db).CheckJoinedParticipant(conn.ClientID, target.GroupID)
+		if err != nil || participant == nil {
+			return nil, errors.New("not a participant of this group")
+		}
+		targetMessage, err := handler.NewMessageHandler(manager.db).GetMessage(target.GroupID, target.TimeCreated, target.AccountinfoID)
+		if err != nil || targetMessage.Deleted || targetMessage.Type != dbmodels.DBMessageType[2] {
+			return nil, errors.New("poll not found")
+		}
+		pollHandler := handler.NewPollHandler(manager.db)
+		poll, err := pollHandler.GetPoll(target)
+		if err != nil {
+			return nil, errors.New("poll not found")
+		}
+		if poll.IsClosed() {
+			return nil, errors.New("the poll is closed")
+		}
+		if !poll.MultipleChoice && len(msg.Data.Choices) != 1 {
+			return nil, errors.New("the poll accepts a single choice")
+		}
+		for i, choice := range msg.Data.Choices {
+			if choice < 0 || choice >= len(poll.Options) || slices.Contains(msg.Data.Choices[:i], choice) {
+				return nil, errors.New("invalid choice " + strconv.Itoa(choice))
+			}
+		}
+		applied, err := pollHandler.AddVote(&dbmodels.PollVote{
+			GroupID:              target.GroupID,
+			MessageTimeCreated:   target.TimeCreated,
+			MessageAccountinfoID: target.AccountinfoID,
+			AccountinfoID:        conn.ClientID,
+			Choices:              msg.Data.Choices,
+			TimeCreated:          time.Now().UTC(),
+		}, targetMessage)
+		if err != nil {
+			return nil, err
+		}
+		if !applied {
+			return nil, errors.New("already voted in this poll")
+		}
+		poll, err = pollHandler.GetPoll(target)
+		if err != nil {
+			return nil, err
+		}
+		listID, err := handler.NewParticipantHandler(manager.db).GetAllParticipantIDsFromGroup(target.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		pollMsg := message.NewOutputMessage(message.MsgTypePoll, message.MsgStatusUpdated, "")
+		pollMsg.Target = target
+		pollMsg.Poll = poll
+		manager.SendToClients(listID, pollMsg)
+		response.Target = target
+		response.Poll = poll
+		return response, nil
+
+	case message.MsgTypeMessagePin, message.MsgTypeMessageUnpin:
+		manager.MessageReceivedCounter.WithLabelValues(msg.Type).Inc()
+		target := msg.Data.Target
+		target.TimeCreated = target.TimeCreated.UTC()
+		participant, err := handler.NewParticipantHandler(manager.db).CheckJoinedParticipant(conn.ClientID, target.GroupID)
+		if err != nil || participant == nil {
+			return nil, errors.New("not a participant of this group")
+		}
+		if participant.Role != conf.PARTICIPANT_ROLE_ADMIN {
+			return nil, errors.New("only a group admin can pin or unpin messages")
+		}
+		pinHandler := handler.NewPinHandler(manager.db)
+		pin := dbmodels.MessagePin{
+			GroupID:              target.GroupID,
+			MessageTimeCreated:   target.TimeCreated,
+			MessageAccountinfoID: target.AccountinfoID,
+			AccountinfoID:        conn.ClientID,
+			TimeCreated:          time.Now().UTC(),
+		}
+		pinMsg := message.NewOutputMessage(message.MsgTypePin, message.MsgStatusDeleted, "")
+		pinMsg.Target = target
+		if msg.Type == message.MsgTypeMessageUnpin {
+			current, err := pinHandler.GetPin(&pin)
+			if err != nil {
+				return nil, err
+			}
+			if current == nil {
+				return nil, errors.New("message not pinned")
+			}
+			if err := pinHandler.RemovePin(&pin); err != nil {
+				return nil, err
+			}
+		} else {
+			targetMessage, err := handler.NewMessageHandler(manager.db).GetMessage(target.GroupID, target.TimeCreated, target.AccountinfoID)
+			if err != nil || targetMessage.Deleted {
+				return nil, errors.New("message not found")
+			}
+			pins, err := pinHandler.GetAllPinsFromGroup(target.GroupID)
+			if err != nil {
+				return nil, err
+			}
+			if len(pins) >= message.PinMax && !slices.ContainsFunc(pins, func(p dbmodels.MessagePin) bool {
+				return p.MessageTimeCreated.Equal(pin.MessageTimeCreated) && p.MessageAccountinfoID == pin.MessageAccountinfoID
+			}) {
+				return nil, fmt.Errorf("a group can have up to %d pinned messages", message.PinMax)
+			}
+			if err := pinHandler.AddPin(&pin, targetMessage); err != nil {
+				return nil, err
+			}
+			pinMsg.Status = message.MsgStatusNew
+			pinMsg.Message = targetMessage
+			manager._sendPinNotifications(targetMessage, conn)
+		}
+		listID, err := handler.NewParticipantHandler(manager.db).GetAllParticipantIDsFromGroup(target.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		manager.SendToClients(listID, pinMsg)
+		return response, nil
+
+	case message.MsgTypePinsList:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypePinsList).Inc()
+		participant, err := handler.NewParticipantHandler(manager.db).CheckJoinedParticipant(conn.ClientID, msg.Data.GroupID)
+		if err != nil || participant == nil {
+			return nil, errors.New("not a participant of this group")
+		}
+		pins, err := handler.NewPinHandler(manager.db).GetAllPinsFromGroup(msg.Data.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		messageHandler := handler.NewMessageHandler(manager.db)
+		messages := make([]dbmodels.Message, 0, len(pins))
+		for _, pin := range pins {
+			pinnedMessage, err := messageHandler.GetMessage(pin.GroupID, pin.MessageTimeCreated, pin.MessageAccountinfoID)
+			// pins of deleted messages are left behind
+			if err != nil || pinnedMessage.Deleted {
+				continue
+			}
+			messages = append(messages, *pinnedMessage)
+		}
+		if err := manager._loadMessageDetails(messages); err != nil {
+			return nil, err
+		}
+		response.Messages = messages
+		return response, nil
+
+	case message.MsgTypeReactionAdd, message.MsgTypeReactionRemove:
+		manager.MessageReceivedCounter.WithLabelValues(msg.Type).Inc()
+		target := msg.Data.Target
+		participant, err := handler.NewParticipantHandler(manager.db).CheckJoinedParticipant(conn.ClientID, target.GroupID)
+		if err != nil || participant == nil {
+			return nil, errors.New("not a participant of this group")
+		}
+		targetMessage, err := handler.NewMessageHandler(manager.db).GetMessage(target.GroupID, target.TimeCreated.UTC(), target.AccountinfoID)
+		if err != nil || targetMessage.Deleted {
+			return nil, errors.New("message not found")
+		}
+		reaction := dbmodels.Reaction{
+			GroupID:              targetMessage.GroupID,
+			MessageTimeCreated:   targetMessage.TimeCreated,
+			MessageAccountinfoID: targetMessage.AccountinfoID,
+			Reaction:             msg.Data.Content,
+			AccountinfoID:        conn.ClientID,
+			TimeCreated:          time.Now().UTC(),
+		}
+		reactionHandler := handler.NewReactionHandler(manager.db)
+		if msg.Type == message.MsgTypeReactionAdd {
+			err = reactionHandler.AddReaction(&reaction, targetMessage)
+		} else {
+			err = reactionHandler.RemoveReaction(&reaction)
+		}
+		if err != nil {
+			return nil, err
+		}
+		summaries, err := reactionHandler.GetReactionSummary(targetMessage.Key())
+		if err != nil {
+			return nil, err
+		}
+		listID, err := handler.NewParticipantHandler(manager.db).GetAllParticipantIDsFromGroup(targetMessage.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		reactionMsg := message.NewOutputMessage(message.MsgTypeReaction, message.MsgStatusUpdated, "")
+		reactionMsg.Target = targetMessage.Key()
+		reactionMsg.Reactions = summaries
+		manager.SendToClients(listID, reactionMsg)
+		response.Target = reactionMsg.Target
+		response.Reactions = summaries
+		return response, nil
+
+	case message.MsgTypeMessageDelivered, message.MsgTypeMessageRead:
+		manager.MessageReceivedCounter.WithLabelValues(msg.Type).Inc()
+		target := msg.Data.Target
+		participantHandler := handler.NewParticipantHandler(manager.db)
+		participant, err := participantHandler.CheckJoinedParticipant(conn.ClientID, target.GroupID)
+		if err != nil || participant == nil {
+			return nil, errors.New("not a participant of this group")
+		}
+		targetMessage, err := handler.NewMessageHandler(manager.db).GetMessage(target.GroupID, target.TimeCreated.UTC(), target.AccountinfoID)
+		if err != nil {
+			return nil, errors.New("message not found")
+		}
+		receiptHandler := handler.NewReceiptHandler(manager.db)
+		receipt := message.ReceiptEvent{AccountinfoID: conn.ClientID}
+		status := message.MsgStatusDelivered
+		if msg.Type == message.MsgTypeMessageDelivered {
+			if targetMessage.AccountinfoID == conn.ClientID {
+				return response, nil
+			}
+			err = receiptHandler.AddDelivery(&dbmodels.MessageDelivery{
+				GroupID:              targetMessage.GroupID,
+				MessageTimeCreated:   targetMessage.TimeCreated,
+				MessageAccountinfoID: targetMessage.AccountinfoID,
+				AccountinfoID:        conn.ClientID,
+				TimeCreated:          time.Now().UTC(),
+			}, targetMessage)
+			if err != nil {
+				return nil, err
+			}
+			receipt.Count, err = receiptHandler.CountDeliveries(targetMessage.Key())
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			marker, err := receiptHandler.GetReadMarker(targetMessage.GroupID, conn.ClientID)
+			if err != nil {
+				return nil, err
+			}
+			if marker != nil && !marker.TimeRead.Before(targetMessage.TimeCreated) {
+				// a later message was already read, read markers only move forward
+				return response, nil
+			}
+			err = receiptHandler.SetReadMarker(&dbmodels.ReadMarker{
+				GroupID:       targetMessage.GroupID,
+				AccountinfoID: conn.ClientID,
+				TimeRead:      targetMessage.TimeCreated,
+				TimeCreated:   time.Now().UTC(),
+			})
+			if err != nil {
+				return nil, err
+			}
+			markers, err := receiptHandler.GetAllReadMarkersFromGroup(targetMessage.GroupID)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range markers {
+				if m.AccountinfoID != targetMessage.AccountinfoID && !m.TimeRead.Before(targetMessage.TimeCreated) {
+					receipt.Count++
+				}
+			}
+			status = message.MsgStatusRead
+		}
+		listID, err := participantHandler.GetAllParticipantIDsFromGroup(targetMessage.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		receiptMsg := message.NewOutputMessage(message.MsgTypeReadReceipt, status, "")
+		receiptMsg.Target = targetMessage.Key()
+		receiptMsg.Receipt = &receipt
+		manager.SendToClients(slices.DeleteFunc(listID, func(id int) bool { return id == conn.ClientID }), receiptMsg)
+		response.Target = receiptMsg.Target
+		response.Receipt = &receipt
+		return response, nil
+
+	case message.MsgTypeTypingStart:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeTypingStart).Inc()
+		if !manager.typing.Start(msg.Data.GroupID, conn.ClientID) {
+			// throttled, the other participants already know
+			return response, nil
+		}
+		participant, err := handler.NewParticipantHandler(manager.db).CheckJoinedParticipant(conn.ClientID, msg.Data.GroupID)
+		if err != nil || participant == nil {
+			manager.typing.Stop(msg.Data.GroupID, conn.ClientID)
+			return nil, errors.New("not a participant of this group")
+		}
+		manager._relayTyping(msg.Data.GroupID, conn.ClientID, message.MsgStatusStart)
+		return response, nil
+
+	case message.MsgTypeTypingStop:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypeTypingStop).Inc()
+		if manager.typing.Stop(msg.Data.GroupID, conn.ClientID) {
+			manager._relayTyping(msg.Data.GroupID, conn.ClientID, message.MsgStatusStop)
+		}
+		return response, nil
+
+	case message.MsgTypePresenceQuery:
+		manager.MessageReceivedCounter.WithLabelValues(message.MsgTypePresenceQuery).Inc()
+		contactIDs, err := manager._getContactIDs(conn.ClientID)
+		if err != nil {
+			return nil, err
+		}
+		// like presence events, the status of an account is only known to the accounts sharing a group with it
+		for _, id := range msg.Data.AccountinfoIDs {
+			online := (id == conn.ClientID || slices.Contains(contactIDs, id)) && manager.presence.IsOnline(id)
+			response.Presence = append(response.Presence, message.PresenceStatus{AccountinfoID: id, Online: online})
+		}
+		return response, nil
 	}
-	return errors.New("invalid message type")
+	return nil, errors.New("invalid message type")
 }
 
 func (manager *ConnectionManager) ProcessRMQMessage(msg []byte) {
@@ -197,8 +1614,9 @@ func (manager *ConnectionManager) ProcessRMQMessage(msg []byte) {
 		parsedMsg := servicemodels.RMQMessage{}
 		if err := json.Unmarshal(msg, &parsedMsg); err != nil {
 			fmt.Println("Error unmarshalling message:", err.Error())
+			return
 		}
-		manager._sendNotificationsForNewMessage(nil, &parsedMsg)
+		manager._sendNewMessage(manager._messageFromRMQ(&parsedMsg))
 	}()
 }
 
@@ -207,19 +1625,43 @@ func (manager *ConnectionManager) ProcessRMQNoti(msg []byte) {
 	// TODO: send noti to client
 }
 
-func (manager *ConnectionManager) AddConnection(conn *websocket.Conn, clientID int, clientName string) *connection.WSConnection {
-	c := &connection.WSConnection{
-		Conn:       conn,
-		ClientID:   clientID,
-		ClientName: clientName,
+// _attachSession resumes the requested session of the connection, or creates a new one if that is not possible.
+func (manager *ConnectionManager) _attachSession(c *connection.WSConnection, sessionID string, lastSeq uint64) {
+	deliver := func(msg *message.OutputMessage) {
+		// the event keeps its seq even if skipped, so the session can still be resumed
+		if !c.Wants(msg) {
+			return
+		}
+		manager.MessageSentCounter.WithLabelValues(msg.Type).Inc()
+		if err := c.WriteJSONMessage(msg); err != nil {
+			fmt.Println("Error sending message to client:", err.Error())
+		}
 	}
+	status := message.MsgStatusNew
+	if sessionID != "" {
+		s, err := manager.sessions.Resume(sessionID, c.ClientID, lastSeq, c, deliver)
+		if err == nil {
+			c.Session = s
+			return
+		}
+		status = message.MsgStatusResync
+	}
+	c.Session = manager.sessions.Create(c.ClientID, status, c, deliver)
+}
+
+func (manager *ConnectionManager) AddConnection(conn *websocket.Conn, clientID int, clientName string, sessionID string, lastSeq uint64) *connection.WSConnection {
+	c := connection.NewWSConnection(conn, clientID, clientName, manager.SendQueueDepthGauge, manager.SendQueueDroppedCounter)
+	c.StartWriter()
+	manager._attachSession(c, sessionID, lastSeq)
 	manager._addConnectionsMutex(c)
+	go manager._sendUnreadSummary(c)
 	return c
 }
 
 func (manager *ConnectionManager) RemoveConnection(c *connection.WSConnection) {
-	defer c.Conn.Close()
+	defer c.Close()
 	manager._removeConnectionsMutex(c)
+	manager.sessions.Detach(c.Session, c)
 }
 
 func (manager *ConnectionManager) ValidateAndAddConnection(w http.ResponseWriter, r *http.Request, respHeader http.Header) (*connection.WSConnection, error) {
@@ -231,21 +1673,21 @@ func (manager *ConnectionManager) ValidateAndAddConnection(w http.ResponseWriter
 	if clientID == 0 {
 		return nil, errors.New("client not found")
 	}
+	// optional, to resume a previous session
+	sessionID := r.URL.Query().Get("session_id")
+	lastSeq, _ := strconv.ParseUint(r.URL.Query().Get("last_seq"), 10, 64)
 	ws, err := upgrader.Upgrade(w, r, respHeader)
 	if err != nil {
 		return nil, err
 	}
-	return manager.AddConnection(ws, clientID, clientName), nil
+	return manager.AddConnection(ws, clientID, clientName, sessionID, lastSeq), nil
 }
 
+// SendToClient sends an event to every session of the client. Connected sessions deliver it right away,
+// the others keep it until the client reconnects.
 func (manager *ConnectionManager) SendToClient(clientID int, outputMessage *message.OutputMessage) {
-	conns := manager._getConnectionsMutex(clientID)
-	for _, conn := range conns {
-		manager.MessageSentCounter.WithLabelValues(message.MsgTypeNotification).Inc()
-		err := conn.WriteJSONMessage(outputMessage)
-		if err != nil {
-			fmt.Println("Error sending message to client:", err.Error())
-		}
+	for _, s := range manager.sessions.GetByClient(clientID) {
+		s.Append(outputMessage)
 	}
 }
 
@@ -255,6 +1697,21 @@ func (manager *ConnectionManager) SendToClients(clientIDs []int, outputMessage *
 	}
 }
 
+// _sendEphemeralToClients sends an event to the live connections of the clients only, without a sequence number.
+func (manager *ConnectionManager) _sendEphemeralToClients(clientIDs []int, outputMessage *message.OutputMessage) {
+	for _, clientID := range clientIDs {
+		for _, conn := range manager._getConnectionsMutex(clientID) {
+			if !conn.Wants(outputMessage) {
+				continue
+			}
+			manager.MessageSentCounter.WithLabelValues(outputMessage.Type).Inc()
+			if err := conn.WriteJSONMessage(outputMessage); err != nil {
+				fmt.Println("Error sending message to client:", err.Error())
+			}
+		}
+	}
+}
+
 func (manager *ConnectionManager) SendToAll(outputMessage *message.OutputMessage) {
 	for clientID, _ := range manager.connectionsByID {
 		manager.SendToClient(clientID, outputMessage)
@@ -1,34 +1,181 @@
 package message
 
 import (
+	"github.com/gocql/gocql"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/db/dbmodels"
-	"github.com/khanhnguyen02311/EchoChat-WS/components/services/servicemodels"
+	"golang.org/x/exp/slices"
+	"regexp"
+	"strconv"
+	"time"
 )
 
 const (
-	MsgTypeMessageNew       = "message-new"
-	MsgTypeNotification     = "notification"
-	MsgTypeNotificationRead = "notification-read"
-	MsgTypeResponse         = "response"
-	MsgTypeHelp             = "help"
-
-	MsgStatusNew     = "new"
-	MsgStatusSuccess = "success"
-	MsgStatusError   = "error"
-	MsgStatusOther   = "other"
+	MsgTypeMessageNew          = "message-new"
+	MsgTypeMessageForward      = "message-forward"
+	MsgTypeUploadBegin         = "upload-begin"
+	MsgTypeUploadChunk         = "upload-chunk"
+	MsgTypeUploadCommit        = "upload-commit"
+	MsgTypeMessage             = "message"
+	MsgTypeMessageHistory      = "message-history"
+	MsgTypeMessageThread       = "message-thread"
+	MsgTypeMessageEdit         = "message-edit"
+	MsgTypeMessageDelete       = "message-delete"
+	MsgTypeReactionAdd         = "reaction-add"
+	MsgTypeReactionRemove      = "reaction-remove"
+	MsgTypeReaction            = "reaction"
+	MsgTypeMessagePin          = "message-pin"
+	MsgTypeMessageUnpin        = "message-unpin"
+	MsgTypePinsList            = "pins-list"
+	MsgTypePin                 = "pin"
+	MsgTypePollVote            = "poll-vote"
+	MsgTypePoll                = "poll"
+	MsgTypeScheduledList       = "scheduled-list"
+	MsgTypeScheduledCancel     = "scheduled-cancel"
+	MsgTypeMessageDelivered    = "message-delivered"
+	MsgTypeMessageRead         = "message-read"
+	MsgTypeReadReceipt         = "read-receipt"
+	MsgTypeNotification        = "notification"
+	MsgTypeNotificationRead    = "notification-read"
+	MsgTypeNotificationList    = "notification-list"
+	MsgTypeNotificationReadAll = "notification-read-all"
+	MsgTypeUnreadSummary       = "unread-summary"
+	MsgTypeResponse            = "response"
+	MsgTypeSession             = "session"
+	MsgTypeTypingStart         = "typing-start"
+	MsgTypeTypingStop          = "typing-stop"
+	MsgTypeTyping              = "typing"
+	MsgTypePresenceQuery       = "presence-query"
+	MsgTypePresence            = "presence"
+	MsgTypeGroupMute           = "group-mute"
+	MsgTypeGroupUnmute         = "group-unmute"
+	MsgTypeGroupFocus          = "group-focus"
+	MsgTypeGroupRetention      = "group-retention"
+	MsgTypeHelp                = "help"
+
+	MsgStatusNew       = "new"
+	MsgStatusSuccess   = "success"
+	MsgStatusError     = "error"
+	MsgStatusOther     = "other"
+	MsgStatusResumed   = "resumed"
+	MsgStatusResync    = "resync"
+	MsgStatusStart     = "start"
+	MsgStatusStop      = "stop"
+	MsgStatusOnline    = "online"
+	MsgStatusOffline   = "offline"
+	MsgStatusEdited    = "edited"
+	MsgStatusDeleted   = "deleted"
+	MsgStatusUpdated   = "updated"
+	MsgStatusDelivered = "delivered"
+	MsgStatusRead      = "read"
+
+	PageSizeDefault = 50
+	PageSizeMax     = 100
+
+	ReactionMaxLength = 64 // in bytes, enough for the longest emoji ZWJ sequences
+
+	FocusGroupMax = 10
+
+	ForwardGroupMax = 10
+
+	PinMax = 50 // per group
+
+	ScheduleMaxDelay = 365 * 24 * time.Hour
+
+	PollOptionMax       = 10
+	PollOptionMaxLength = 100 // in bytes
+
+	ExpiresInMax = 30 * 24 * 60 * 60 // in seconds, 30 days
+
+	MentionMax = 50 // further mentions in the same message are ignored
+
+	MuteMaxDuration = 365 * 24 * time.Hour // one year, longer mutes should turn off the notifications instead
 )
 
+// mentionPattern matches "@123" (an account id) and "@all".
+var mentionPattern = regexp.MustCompile(`@(\d+|all)\b`)
+
+// InputMsgTypes lists the message types accepted from clients.
+var InputMsgTypes = []string{MsgTypeMessageNew, MsgTypeNotificationRead, MsgTypeMessageHistory, MsgTypeMessageThread, MsgTypeMessageEdit, MsgTypeMessageDelete,
+	MsgTypeReactionAdd, MsgTypeReactionRemove, MsgTypeMessageDelivered, MsgTypeMessageRead, MsgTypeTypingStart, MsgTypeTypingStop, MsgTypePresenceQuery,
+	MsgTypeNotificationList, MsgTypeNotificationReadAll, MsgTypeGroupMute, MsgTypeGroupUnmute,
+	MsgTypeGroupFocus, MsgTypeGroupRetention, MsgTypeMessagePin, MsgTypeMessageUnpin, MsgTypePinsList,
+	MsgTypePollVote, MsgTypeScheduledList, MsgTypeScheduledCancel, MsgTypeMessageForward,
+	MsgTypeUploadBegin, MsgTypeUploadChunk, MsgTypeUploadCommit}
+
 type InputMessage struct {
-	Type string                `json:"type"`
-	Data *dbmodels.MessagePOST `json:"data"`
+	Type      string                `json:"type"`
+	RequestID string                `json:"request_id"`
+	Data      *dbmodels.MessagePOST `json:"data"`
 }
 
 type OutputMessage struct {
-	Type         string                    `json:"type"`
-	Status       string                    `json:"status"`
-	Message      *servicemodels.RMQMessage `json:"message"`
-	Notification *dbmodels.Notification    `json:"notification"`
-	Content      string                    `json:"content"`
+	Type          string                      `json:"type"`
+	Status        string                      `json:"status"`
+	RequestID     string                      `json:"request_id,omitempty"` // echoed from the input message this responds to
+	EntityID      string                      `json:"entity_id,omitempty"`  // id of the entity created by the input message
+	Message       *dbmodels.Message           `json:"message"`
+	Notification  *dbmodels.Notification      `json:"notification"`
+	Content       string                      `json:"content"`
+	Messages      []dbmodels.Message          `json:"messages,omitempty"`
+	Notifications []dbmodels.Notification     `json:"notifications,omitempty"`
+	Cursor        string                      `json:"cursor,omitempty"` // opaque cursor of the next page, empty on the last page
+	SessionID     string                      `json:"session_id,omitempty"`
+	Seq           uint64                      `json:"seq,omitempty"` // sequence number of the event within the session
+	Typing        *TypingEvent                `json:"typing,omitempty"`
+	Presence      []PresenceStatus            `json:"presence,omitempty"`
+	Target        *dbmodels.MessageKey        `json:"target,omitempty"` // the message the event is about, if it is not in "message"
+	Reactions     []dbmodels.ReactionSummary  `json:"reactions,omitempty"`
+	Receipt       *ReceiptEvent               `json:"receipt,omitempty"`
+	Poll          *dbmodels.Poll              `json:"poll,omitempty"`
+	Scheduled     []dbmodels.ScheduledMessage `json:"scheduled,omitempty"`
+	Upload        *dbmodels.FileUpload        `json:"upload,omitempty"`
+	Unread        []dbmodels.UnreadCount      `json:"unread,omitempty"`
+}
+
+// GroupID returns the group of a live event which only matters to the viewers of the group (messages, reactions,
+// read receipts, pins, polls and typing), or nil for any other event.
+func (m *OutputMessage) GroupID() *gocql.UUID {
+	switch {
+	case m.Type == MsgTypeMessage && m.Message != nil:
+		return &m.Message.GroupID
+	case (m.Type == MsgTypeReaction || m.Type == MsgTypeReadReceipt || m.Type == MsgTypePin || m.Type == MsgTypePoll) && m.Target != nil:
+		return &m.Target.GroupID
+	case m.Type == MsgTypeTyping && m.Typing != nil:
+		return &m.Typing.GroupID
+	}
+	return nil
+}
+
+// ReceiptEvent tells that an account received or read a message.
+type ReceiptEvent struct {
+	AccountinfoID int `json:"accountinfo_id"`
+	Count         int `json:"count"` // number of accounts which received or read the message, except its author
+}
+
+// TypingEvent tells that a participant started or stopped typing in a group.
+type TypingEvent struct {
+	GroupID       gocql.UUID `json:"group_id"`
+	AccountinfoID int        `json:"accountinfo_id"`
+}
+
+// ParseMentions returns the distinct account ids mentioned in a message content, and whether it mentions "@all".
+func ParseMentions(content string) ([]int, bool) {
+	var ids []int
+	all := false
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		if match[1] == "all" {
+			all = true
+			continue
+		}
+		id, err := strconv.Atoi(match[1])
+		if err != nil || id <= 0 || slices.Contains(ids, id) {
+			continue
+		}
+		if len(ids) < MentionMax {
+			ids = append(ids, id)
+		}
+	}
+	return ids, all
 }
 
 func NewInputMessage(msgType string, data *dbmodels.MessagePOST) *InputMessage {
@@ -45,3 +192,9 @@ func NewOutputMessage(msgType string, msgStatus string, msgContent string) *Outp
 		Content: msgContent,
 	}
 }
+
+// PresenceStatus tells whether an account has at least one live connection.
+type PresenceStatus struct {
+	AccountinfoID int  `json:"accountinfo_id"`
+	Online        bool `json:"online"`
+}
@@ -0,0 +1,44 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	var many []string
+	var first []int
+	for id := 1; id <= MentionMax+10; id++ {
+		many = append(many, fmt.Sprintf("@%d", id))
+		if id <= MentionMax {
+			first = append(first, id)
+		}
+	}
+	tests := []struct {
+		name    string
+		content string
+		ids     []int
+		all     bool
+	}{
+		{name: "no mention", content: "hello world"},
+		{name: "one mention", content: "hello @12", ids: []int{12}},
+		{name: "mentions in order", content: "@3, @1 and @2!", ids: []int{3, 1, 2}},
+		{name: "duplicate mentions", content: "@7 @7 @7", ids: []int{7}},
+		{name: "all", content: "@all look", all: true},
+		{name: "all and accounts", content: "@5 @all @6", ids: []int{5, 6}, all: true},
+		{name: "word starting with all", content: "@alliance"},
+		{name: "id followed by letters", content: "@12abc"},
+		{name: "zero id", content: "@0"},
+		{name: "id out of range", content: "@99999999999999999999"},
+		{name: "limited mentions", content: strings.Join(many, " "), ids: first},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ids, all := ParseMentions(test.content)
+			if fmt.Sprint(ids) != fmt.Sprint(test.ids) || all != test.all {
+				t.Errorf("ParseMentions(%q) = %v, %v, want %v, %v", test.content, ids, all, test.ids, test.all)
+			}
+		})
+	}
+}
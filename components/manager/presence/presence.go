@@ -0,0 +1,65 @@
+package presence
+
+import (
+	conf "github.com/khanhnguyen02311/EchoChat-WS/configurations"
+	"sync"
+	"time"
+)
+
+// Tracker keeps which clients are online.
+//
+// A client goes online when its first connection opens, and offline WS_PRESENCE_GRACE after its last connection
+// closed, unless it reconnected in the meantime. Changes are reported to onChange in a new goroutine.
+type Tracker struct {
+	mutex    sync.Mutex
+	online   map[int]*time.Timer // pending offline timer of the client, nil while connected
+	onChange func(clientID int, online bool)
+}
+
+func NewTracker(onChange func(clientID int, online bool)) *Tracker {
+	return &Tracker{
+		online:   make(map[int]*time.Timer),
+		onChange: onChange,
+	}
+}
+
+// Connected is called when the first connection of a client opens.
+func (t *Tracker) Connected(clientID int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	timer, ok := t.online[clientID]
+	t.online[clientID] = nil
+	if ok {
+		// reconnected within the grace period, nobody saw it go offline
+		if timer != nil {
+			timer.Stop()
+		}
+		return
+	}
+	go t.onChange(clientID, true)
+}
+
+// Disconnected is called when the last connection of a client closes.
+func (t *Tracker) Disconnected(clientID int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var timer *time.Timer
+	timer = time.AfterFunc(conf.WS_PRESENCE_GRACE, func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		if t.online[clientID] != timer {
+			return
+		}
+		delete(t.online, clientID)
+		go t.onChange(clientID, false)
+	})
+	t.online[clientID] = timer
+}
+
+// IsOnline reports whether the client is online, including during the grace period after its last connection closed.
+func (t *Tracker) IsOnline(clientID int) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, ok := t.online[clientID]
+	return ok
+}
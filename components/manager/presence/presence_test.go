@@ -0,0 +1,130 @@
+package presence
+
+import (
+	conf "github.com/khanhnguyen02311/EchoChat-WS/configurations"
+	"sync"
+	"testing"
+	"time"
+)
+
+type change struct {
+	clientID int
+	online   bool
+}
+
+// changes records the calls of onChange.
+type changes struct {
+	mutex   sync.Mutex
+	changes []change
+}
+
+func (c *changes) onChange(clientID int, online bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.changes = append(c.changes, change{clientID: clientID, online: online})
+}
+
+func (c *changes) get() []change {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]change(nil), c.changes...)
+}
+
+func TestTracker(t *testing.T) {
+	conf.WS_PRESENCE_GRACE = 20 * time.Millisecond
+	type step struct {
+		connect    bool
+		disconnect bool
+		clientID   int
+		sleep      time.Duration // after the step
+	}
+	tests := []struct {
+		name    string
+		steps   []step
+		online  map[int]bool
+		changes []change
+	}{
+		{
+			name:    "connected",
+			steps:   []step{{connect: true, clientID: 1}},
+			online:  map[int]bool{1: true, 2: false},
+			changes: []change{{1, true}},
+		},
+		{
+			name:    "online during the grace period",
+			steps:   []step{{connect: true, clientID: 1}, {disconnect: true, clientID: 1}},
+			online:  map[int]bool{1: true},
+			changes: []change{{1, true}},
+		},
+		{
+			name: "offline after the grace period",
+			steps: []step{
+				{connect: true, clientID: 1},
+				{disconnect: true, clientID: 1, sleep: 5 * conf.WS_PRESENCE_GRACE},
+			},
+			online:  map[int]bool{1: false},
+			changes: []change{{1, true}, {1, false}},
+		},
+		{
+			name: "reconnected within the grace period",
+			steps: []step{
+				{connect: true, clientID: 1},
+				{disconnect: true, clientID: 1, sleep: conf.WS_PRESENCE_GRACE / 2},
+				{connect: true, clientID: 1, sleep: 5 * conf.WS_PRESENCE_GRACE},
+			},
+			online:  map[int]bool{1: true},
+			changes: []change{{1, true}},
+		},
+		{
+			name: "online again after the grace period",
+			steps: []step{
+				{connect: true, clientID: 1},
+				{disconnect: true, clientID: 1, sleep: 5 * conf.WS_PRESENCE_GRACE},
+				{connect: true, clientID: 1},
+			},
+			online:  map[int]bool{1: true},
+			changes: []change{{1, true}, {1, false}, {1, true}},
+		},
+		{
+			name: "disconnected twice goes offline once",
+			steps: []step{
+				{connect: true, clientID: 1},
+				{disconnect: true, clientID: 1, sleep: conf.WS_PRESENCE_GRACE / 2},
+				{disconnect: true, clientID: 1, sleep: 5 * conf.WS_PRESENCE_GRACE},
+			},
+			online:  map[int]bool{1: false},
+			changes: []change{{1, true}, {1, false}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &changes{}
+			tracker := NewTracker(c.onChange)
+			for _, step := range test.steps {
+				if step.connect {
+					tracker.Connected(step.clientID)
+				}
+				if step.disconnect {
+					tracker.Disconnected(step.clientID)
+				}
+				// changes are reported in new goroutines, let them run in order
+				time.Sleep(step.sleep + time.Millisecond)
+			}
+			for clientID, want := range test.online {
+				if got := tracker.IsOnline(clientID); got != want {
+					t.Errorf("client %d online %v, want %v", clientID, got, want)
+				}
+			}
+			got := c.get()
+			if len(got) != len(test.changes) {
+				t.Fatalf("changes %v, want %v", got, test.changes)
+			}
+			for i := range got {
+				if got[i] != test.changes[i] {
+					t.Errorf("changes %v, want %v", got, test.changes)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package session
+
+import (
+	"errors"
+	"github.com/gocql/gocql"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/manager/message"
+	conf "github.com/khanhnguyen02311/EchoChat-WS/configurations"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrResyncRequired  = errors.New("missed events are no longer available")
+)
+
+// A Session outlives the connections of a client.
+//
+// Every event sent through it gets the next sequence number and is kept in a buffer of the last
+// WS_SESSION_BUFFER_SIZE events, so that a client reconnecting with its session ID and last received sequence number
+// can get the events it missed. A session without a connection expires after WS_SESSION_TTL.
+type Session struct {
+	ID       string
+	ClientID int
+	mutex    sync.Mutex
+	lastSeq  uint64
+	events   []*message.OutputMessage // oldest first
+	owner    any                      // the connection currently attached, nil if detached
+	deliver  func(msg *message.OutputMessage)
+	expiry   *time.Timer
+	removed  bool // removed from the store, it cannot be resumed anymore
+}
+
+// Append assigns the next sequence number to a copy of the event, buffers it and delivers it to the attached connection.
+func (s *Session) Append(msg *message.OutputMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastSeq++
+	event := *msg
+	event.Seq = s.lastSeq
+	if len(s.events) >= conf.WS_SESSION_BUFFER_SIZE {
+		s.events[0] = nil
+		s.events = s.events[1:]
+	}
+	s.events = append(s.events, &event)
+	if s.deliver != nil {
+		s.deliver(&event)
+	}
+}
+
+func (s *Session) _announce(status string) {
+	announcement := message.NewOutputMessage(message.MsgTypeSession, status, "")
+	announcement.SessionID = s.ID
+	announcement.Seq = s.lastSeq
+	s.deliver(announcement)
+}
+
+// Store keeps the sessions of all clients.
+type Store struct {
+	mutex            sync.RWMutex
+	sessions         map[string]*Session
+	sessionsByClient map[int][]*Session
+}
+
+func NewStore() *Store {
+	return &Store{
+		sessions:         make(map[string]*Session),
+		sessionsByClient: make(map[int][]*Session),
+	}
+}
+
+// Create starts a new session attached to owner, and announces it with the given status.
+func (st *Store) Create(clientID int, status string, owner any, deliver func(msg *message.OutputMessage)) *Session {
+	s := &Session{
+		ID:       gocql.TimeUUID().String(),
+		ClientID: clientID,
+		owner:    owner,
+		deliver:  deliver,
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	st.mutex.Lock()
+	st.sessions[s.ID] = s
+	st.sessionsByClient[clientID] = append(st.sessionsByClient[clientID], s)
+	st.mutex.Unlock()
+	s._announce(status)
+	return s
+}
+
+// Resume attaches owner to an existing session of the client, then delivers the announcement and every event after lastSeq.
+//
+// It fails with ErrResyncRequired if some of these events are no longer buffered.
+func (st *Store) Resume(sessionID string, clientID int, lastSeq uint64, owner any, deliver func(msg *message.OutputMessage)) (*Session, error) {
+	st.mutex.RLock()
+	s, ok := st.sessions[sessionID]
+	st.mutex.RUnlock()
+	if !ok || s.ClientID != clientID {
+		return nil, ErrSessionNotFound
+	}
+	return s._attach(lastSeq, owner, deliver)
+}
+
+func (s *Session) _attach(lastSeq uint64, owner any, deliver func(msg *message.OutputMessage)) (*Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.removed {
+		// expired after it was looked up
+		return nil, ErrSessionNotFound
+	}
+	if lastSeq > s.lastSeq || s.lastSeq-lastSeq > uint64(len(s.events)) {
+		return nil, ErrResyncRequired
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	// a connection still attached to the session (e.g. a half-open one) stops receiving events
+	s.owner = owner
+	s.deliver = deliver
+	s._announce(message.MsgStatusResumed)
+	for _, event := range s.events {
+		if event.Seq > lastSeq {
+			s.deliver(event)
+		}
+	}
+	return s, nil
+}
+
+// Detach removes owner from the session if it is still attached, and schedules the session to expire.
+func (st *Store) Detach(s *Session, owner any) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.owner != owner {
+		return
+	}
+	s.owner = nil
+	s.deliver = nil
+	s.expiry = time.AfterFunc(conf.WS_SESSION_TTL, func() {
+		st.Remove(s)
+	})
+}
+
+// Remove deletes the session, unless a connection has been attached to it again. A Resume which looked the session up
+// before it was deleted fails.
+func (st *Store) Remove(s *Session) {
+	s.mutex.Lock()
+	attached := s.owner != nil
+	if !attached {
+		s.removed = true
+	}
+	s.mutex.Unlock()
+	if attached {
+		return
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	delete(st.sessions, s.ID)
+	for i, c := range st.sessionsByClient[s.ClientID] {
+		if c != s {
+			continue
+		}
+		if len(st.sessionsByClient[s.ClientID]) == 1 {
+			delete(st.sessionsByClient, s.ClientID)
+		} else {
+			st.sessionsByClient[s.ClientID] = append(
+				st.sessionsByClient[s.ClientID][:i], st.sessionsByClient[s.ClientID][i+1:]...)
+		}
+		break
+	}
+}
+
+// GetByClient returns all sessions of a client, with or without a connection attached.
+func (st *Store) GetByClient(clientID int) []*Session {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return append([]*Session(nil), st.sessionsByClient[clientID]...)
+}
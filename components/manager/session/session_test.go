@@ -0,0 +1,193 @@
+package session
+
+import (
+	"errors"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/manager/message"
+	conf "github.com/khanhnguyen02311/EchoChat-WS/configurations"
+	"testing"
+	"time"
+)
+
+// recorder keeps the messages delivered to a connection.
+type recorder struct {
+	messages []*message.OutputMessage
+}
+
+func (r *recorder) deliver(msg *message.OutputMessage) {
+	r.messages = append(r.messages, msg)
+}
+
+func (r *recorder) seqs() []uint64 {
+	var seqs []uint64
+	for _, msg := range r.messages {
+		if msg.Type != message.MsgTypeSession {
+			seqs = append(seqs, msg.Seq)
+		}
+	}
+	return seqs
+}
+
+func equalSeqs(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAppendOverflow(t *testing.T) {
+	conf.WS_SESSION_BUFFER_SIZE = 3
+	store := NewStore()
+	conn := &recorder{}
+	s := store.Create(1, message.MsgStatusNew, conn, conn.deliver)
+	for i := 0; i < 10; i++ {
+		s.Append(message.NewOutputMessage(message.MsgTypeMessage, message.MsgStatusNew, ""))
+	}
+	if want := []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}; !equalSeqs(conn.seqs(), want) {
+		t.Errorf("delivered %v, want %v", conn.seqs(), want)
+	}
+	var buffered []uint64
+	for _, event := range s.events {
+		buffered = append(buffered, event.Seq)
+	}
+	if want := []uint64{8, 9, 10}; !equalSeqs(buffered, want) {
+		t.Errorf("buffered %v, want %v", buffered, want)
+	}
+}
+
+func TestResume(t *testing.T) {
+	conf.WS_SESSION_BUFFER_SIZE = 4
+	conf.WS_SESSION_TTL = time.Minute
+	tests := []struct {
+		name     string
+		appended int
+		clientID int
+		lastSeq  uint64
+		err      error
+		replayed []uint64
+	}{
+		{name: "nothing missed", appended: 6, clientID: 1, lastSeq: 6},
+		{name: "missed events buffered", appended: 6, clientID: 1, lastSeq: 2, replayed: []uint64{3, 4, 5, 6}},
+		{name: "one missed event dropped", appended: 6, clientID: 1, lastSeq: 1, err: ErrResyncRequired},
+		{name: "nothing received", appended: 6, clientID: 1, lastSeq: 0, err: ErrResyncRequired},
+		{name: "nothing received, nothing sent", appended: 0, clientID: 1, lastSeq: 0},
+		{name: "ahead of the session", appended: 6, clientID: 1, lastSeq: 7, err: ErrResyncRequired},
+		{name: "session of another client", appended: 6, clientID: 2, lastSeq: 6, err: ErrSessionNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewStore()
+			oldConn := &recorder{}
+			s := store.Create(1, message.MsgStatusNew, oldConn, oldConn.deliver)
+			for i := 0; i < test.appended; i++ {
+				s.Append(message.NewOutputMessage(message.MsgTypeMessage, message.MsgStatusNew, ""))
+			}
+			store.Detach(s, oldConn)
+
+			newConn := &recorder{}
+			resumed, err := store.Resume(s.ID, test.clientID, test.lastSeq, newConn, newConn.deliver)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+			if err != nil {
+				if len(newConn.messages) != 0 {
+					t.Errorf("delivered %d messages after a failed resume", len(newConn.messages))
+				}
+				return
+			}
+			if resumed != s {
+				t.Fatal("resumed another session")
+			}
+			announcement := newConn.messages[0]
+			if announcement.Type != message.MsgTypeSession || announcement.Status != message.MsgStatusResumed ||
+				announcement.Seq != uint64(test.appended) {
+				t.Errorf("announcement %+v", announcement)
+			}
+			if !equalSeqs(newConn.seqs(), test.replayed) {
+				t.Errorf("replayed %v, want %v", newConn.seqs(), test.replayed)
+			}
+		})
+	}
+}
+
+func TestResumeUnknownSession(t *testing.T) {
+	conn := &recorder{}
+	if _, err := NewStore().Resume("unknown", 1, 0, conn, conn.deliver); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("error %v, want %v", err, ErrSessionNotFound)
+	}
+}
+
+func TestResumeTakesOverAttachedConnection(t *testing.T) {
+	conf.WS_SESSION_BUFFER_SIZE = 4
+	store := NewStore()
+	oldConn := &recorder{}
+	s := store.Create(1, message.MsgStatusNew, oldConn, oldConn.deliver)
+	newConn := &recorder{}
+	if _, err := store.Resume(s.ID, 1, 0, newConn, newConn.deliver); err != nil {
+		t.Fatal(err)
+	}
+	s.Append(message.NewOutputMessage(message.MsgTypeMessage, message.MsgStatusNew, ""))
+	if len(oldConn.seqs()) != 0 || !equalSeqs(newConn.seqs(), []uint64{1}) {
+		t.Errorf("old connection got %v, new connection got %v", oldConn.seqs(), newConn.seqs())
+	}
+	// the old connection closing late must not detach the new one
+	store.Detach(s, oldConn)
+	if s.owner != newConn {
+		t.Error("a stale connection detached the session")
+	}
+}
+
+func TestDetachExpiry(t *testing.T) {
+	conf.WS_SESSION_BUFFER_SIZE = 4
+	conf.WS_SESSION_TTL = 20 * time.Millisecond
+	tests := []struct {
+		name    string
+		resume  bool
+		removed bool
+	}{
+		{name: "detached session expires", removed: true},
+		{name: "resumed session is kept", resume: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewStore()
+			conn := &recorder{}
+			s := store.Create(1, message.MsgStatusNew, conn, conn.deliver)
+			store.Detach(s, conn)
+			if test.resume {
+				if _, err := store.Resume(s.ID, 1, 0, conn, conn.deliver); err != nil {
+					t.Fatal(err)
+				}
+			}
+			time.Sleep(5 * conf.WS_SESSION_TTL)
+			if removed := len(store.GetByClient(1)) == 0; removed != test.removed {
+				t.Errorf("removed %v, want %v", removed, test.removed)
+			}
+			if _, err := store.Resume(s.ID, 1, 0, conn, conn.deliver); (err != nil) != test.removed {
+				t.Errorf("resume after the TTL: %v", err)
+			}
+		})
+	}
+}
+
+func TestResumeRemovedSession(t *testing.T) {
+	conf.WS_SESSION_BUFFER_SIZE = 4
+	conf.WS_SESSION_TTL = time.Minute
+	store := NewStore()
+	oldConn := &recorder{}
+	s := store.Create(1, message.MsgStatusNew, oldConn, oldConn.deliver)
+	store.Detach(s, oldConn)
+	// a Resume which looked the session up just before it expired
+	store.Remove(s)
+	newConn := &recorder{}
+	if _, err := s._attach(0, newConn, newConn.deliver); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("error %v, want %v", err, ErrSessionNotFound)
+	}
+	if len(newConn.messages) != 0 {
+		t.Error("a removed session delivered messages")
+	}
+}
@@ -0,0 +1,83 @@
+package typing
+
+import (
+	"github.com/gocql/gocql"
+	conf "github.com/khanhnguyen02311/EchoChat-WS/configurations"
+	"sync"
+	"time"
+)
+
+type typingKey struct {
+	groupID  gocql.UUID
+	clientID int
+}
+
+type typingState struct {
+	lastRelayed time.Time
+	deadline    time.Time
+	expiry      *time.Timer
+}
+
+// Tracker keeps which clients are typing in which groups.
+//
+// A client stops typing when it says so, or after WS_TYPING_TIMEOUT without a new start.
+// Repeated starts are relayed at most once every WS_TYPING_THROTTLE.
+type Tracker struct {
+	mutex    sync.Mutex
+	states   map[typingKey]*typingState
+	onExpire func(groupID gocql.UUID, clientID int)
+}
+
+// NewTracker creates a Tracker which calls onExpire when a client stops typing without saying so.
+func NewTracker(onExpire func(groupID gocql.UUID, clientID int)) *Tracker {
+	return &Tracker{
+		states:   make(map[typingKey]*typingState),
+		onExpire: onExpire,
+	}
+}
+
+// Start records that the client is typing in the group. It returns false if the start should not be relayed.
+func (t *Tracker) Start(groupID gocql.UUID, clientID int) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	key := typingKey{groupID: groupID, clientID: clientID}
+	state, ok := t.states[key]
+	if ok {
+		state.deadline = time.Now().Add(conf.WS_TYPING_TIMEOUT)
+		state.expiry.Reset(conf.WS_TYPING_TIMEOUT)
+		if time.Since(state.lastRelayed) < conf.WS_TYPING_THROTTLE {
+			return false
+		}
+		state.lastRelayed = time.Now()
+		return true
+	}
+	state = &typingState{lastRelayed: time.Now(), deadline: time.Now().Add(conf.WS_TYPING_TIMEOUT)}
+	state.expiry = time.AfterFunc(conf.WS_TYPING_TIMEOUT, func() {
+		t.mutex.Lock()
+		// the timer may fire while a new start is extending the deadline
+		expired := t.states[key] == state && !time.Now().Before(state.deadline)
+		if expired {
+			delete(t.states, key)
+		}
+		t.mutex.Unlock()
+		if expired {
+			t.onExpire(groupID, clientID)
+		}
+	})
+	t.states[key] = state
+	return true
+}
+
+// Stop records that the client stopped typing in the group. It returns false if the client was not typing.
+func (t *Tracker) Stop(groupID gocql.UUID, clientID int) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	key := typingKey{groupID: groupID, clientID: clientID}
+	state, ok := t.states[key]
+	if !ok {
+		return false
+	}
+	state.expiry.Stop()
+	delete(t.states, key)
+	return true
+}
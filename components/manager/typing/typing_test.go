@@ -0,0 +1,137 @@
+package typing
+
+import (
+	"github.com/gocql/gocql"
+	conf "github.com/khanhnguyen02311/EchoChat-WS/configurations"
+	"sync"
+	"testing"
+	"time"
+)
+
+// expiries records the calls of onExpire.
+type expiries struct {
+	mutex sync.Mutex
+	keys  []typingKey
+}
+
+func (e *expiries) onExpire(groupID gocql.UUID, clientID int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.keys = append(e.keys, typingKey{groupID: groupID, clientID: clientID})
+}
+
+func (e *expiries) count() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return len(e.keys)
+}
+
+func TestStartStop(t *testing.T) {
+	conf.WS_TYPING_TIMEOUT = time.Minute
+	conf.WS_TYPING_THROTTLE = 20 * time.Millisecond
+	group, otherGroup := gocql.TimeUUID(), gocql.TimeUUID()
+	type step struct {
+		stop     bool
+		groupID  gocql.UUID
+		clientID int
+		sleep    time.Duration // before the step
+		want     bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "first start is relayed", steps: []step{
+			{groupID: group, clientID: 1, want: true},
+		}},
+		{name: "repeated start is throttled", steps: []step{
+			{groupID: group, clientID: 1, want: true},
+			{groupID: group, clientID: 1, want: false},
+			{groupID: group, clientID: 1, sleep: 2 * conf.WS_TYPING_THROTTLE, want: true},
+		}},
+		{name: "start after stop is relayed", steps: []step{
+			{groupID: group, clientID: 1, want: true},
+			{stop: true, groupID: group, clientID: 1, want: true},
+			{groupID: group, clientID: 1, want: true},
+		}},
+		{name: "stop without start is not relayed", steps: []step{
+			{stop: true, groupID: group, clientID: 1, want: false},
+			{groupID: group, clientID: 1, want: true},
+			{stop: true, groupID: group, clientID: 1, want: true},
+			{stop: true, groupID: group, clientID: 1, want: false},
+		}},
+		{name: "groups and clients are independent", steps: []step{
+			{groupID: group, clientID: 1, want: true},
+			{groupID: otherGroup, clientID: 1, want: true},
+			{groupID: group, clientID: 2, want: true},
+			{stop: true, groupID: otherGroup, clientID: 2, want: false},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := &expiries{}
+			tracker := NewTracker(e.onExpire)
+			for i, step := range test.steps {
+				time.Sleep(step.sleep)
+				var got bool
+				if step.stop {
+					got = tracker.Stop(step.groupID, step.clientID)
+				} else {
+					got = tracker.Start(step.groupID, step.clientID)
+				}
+				if got != step.want {
+					t.Errorf("step %d: got %v, want %v", i, got, step.want)
+				}
+			}
+			if e.count() != 0 {
+				t.Errorf("%d unexpected expiries", e.count())
+			}
+		})
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	conf.WS_TYPING_TIMEOUT = 20 * time.Millisecond
+	conf.WS_TYPING_THROTTLE = time.Minute
+	group := gocql.TimeUUID()
+	tests := []struct {
+		name     string
+		stop     bool
+		restart  bool // start again before the timeout
+		expiries int
+	}{
+		{name: "expires after the timeout", expiries: 1},
+		{name: "stopped before the timeout", stop: true},
+		{name: "restart extends the deadline", restart: true, expiries: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := &expiries{}
+			tracker := NewTracker(e.onExpire)
+			tracker.Start(group, 1)
+			if test.stop {
+				tracker.Stop(group, 1)
+			}
+			if test.restart {
+				time.Sleep(conf.WS_TYPING_TIMEOUT / 2)
+				tracker.Start(group, 1)
+				time.Sleep(conf.WS_TYPING_TIMEOUT * 3 / 4)
+				if e.count() != 0 {
+					t.Fatal("expired before the extended deadline")
+				}
+			}
+			time.Sleep(5 * conf.WS_TYPING_TIMEOUT)
+			if e.count() != test.expiries {
+				t.Fatalf("%d expiries, want %d", e.count(), test.expiries)
+			}
+			if test.expiries > 0 {
+				if e.keys[0] != (typingKey{groupID: group, clientID: 1}) {
+					t.Errorf("expired %+v", e.keys[0])
+				}
+				if tracker.Stop(group, 1) {
+					t.Error("an expired client is still typing")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/db"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/db/dbmodels"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/handler"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/manager"
+	conf "github.com/khanhnguyen02311/EchoChat-WS/configurations"
+	"sync"
+	"time"
+)
+
+// SchedulerService sends the scheduled messages when they are due, and the expiry events of ephemeral messages,
+// removes their files, decrements the unread counts of expired notifications, and removes the chunks of expired uploads.
+//
+// Every instance of the server runs a scheduler. A message is claimed with a lightweight transaction before being sent,
+// so it is sent by one instance only, and a claim left by a crashed instance is taken over after a timeout. Expiry
+// events are not claimed: every instance tells its own connections. Expired uploads are not claimed either, removing
+// their chunks twice is harmless. Expired unread counts are claimed by removing their expiry with a lightweight transaction,
+// so that each one is decremented once.
+type SchedulerService struct {
+	db *db.ScyllaDB
+}
+
+func NewSchedulerService(db *db.ScyllaDB) *SchedulerService {
+	return &SchedulerService{
+		db: db,
+	}
+}
+
+func (s *SchedulerService) StartScheduling(ctx context.Context, manager *manager.ConnectionManager, wg *sync.WaitGroup) {
+	go func() {
+		defer wg.Done()
+		// catch up with the messages which were due while no instance was running
+		s.sendDueMessages(manager, time.Now().Add(-conf.SCHEDULER_LOOKBACK))
+		// the connections of this instance did not exist before it started, they have no expired message to drop
+		expiredUntil := time.Now().UTC()
+		uploadsFrom := time.Now().Add(-conf.SCHEDULER_LOOKBACK)
+		unreadFrom := uploadsFrom
+		ticker := time.NewTicker(conf.SCHEDULER_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done(): // exit when context is canceled
+				return
+			case <-ticker.C:
+				// the previous bucket may still hold messages due just before the hour
+				s.sendDueMessages(manager, time.Now().Add(-time.Hour))
+				expiredUntil = s.sendExpiries(manager, expiredUntil)
+				uploadsFrom = s.removeExpiredUploads(manager, uploadsFrom)
+				unreadFrom = s.removeExpiredUnreadCounts(manager, unreadFrom)
+			}
+		}
+	}()
+}
+
+// sendDueMessages sends the messages due from the bucket of "from" until now.
+func (s *SchedulerService) sendDueMessages(manager *manager.ConnectionManager, from time.Time) {
+	scheduledHandler := handler.NewScheduledMessageHandler(s.db)
+	now := time.Now().UTC()
+	for bucket := from.UTC().Truncate(time.Hour); !bucket.After(now); bucket = bucket.Add(time.Hour) {
+		due, err := scheduledHandler.GetDueScheduledMessages(bucket, now)
+		if err != nil {
+			continue
+		}
+		for i := range due {
+			if s.claim(scheduledHandler, &due[i], now) {
+				s.send(scheduledHandler, manager, &due[i])
+			}
+		}
+	}
+}
+
+// claim marks a due message as being sent by this instance, and tells whether it succeeded.
+func (s *SchedulerService) claim(scheduledHandler *handler.ScheduledMessageHandler, scheduled *dbmodels.ScheduledMessage, now time.Time) bool {
+	switch scheduled.Status {
+	case dbmodels.DBScheduledStatus[0]:
+	case dbmodels.DBScheduledStatus[1]:
+		// the instance which claimed the message did not finish in time, it probably stopped
+		if scheduled.TimeClaimed != nil && now.Sub(*scheduled.TimeClaimed) < conf.SCHEDULER_CLAIM_TIMEOUT {
+			return false
+		}
+	default:
+		return false
+	}
+	claimed, err := scheduledHandler.SetScheduledMessageStatus(scheduled, dbmodels.DBScheduledStatus[1])
+	return err == nil && claimed
+}
+
+func (s *SchedulerService) send(scheduledHandler *handler.ScheduledMessageHandler, manager *manager.ConnectionManager, scheduled *dbmodels.ScheduledMessage) {
+	status := dbmodels.DBScheduledStatus[2]
+	if err := manager.SendScheduledMessage(scheduled); err != nil {
+		// the sender may have left the group since the message was scheduled
+		fmt.Println("An error occurred while sending scheduled message", scheduled.ID.String(), err.Error())
+		status = dbmodels.DBScheduledStatus[4]
+	}
+	// the account does not wait for the message anymore either way; a status left at "Sending" is taken over after
+	// SCHEDULER_CLAIM_TIMEOUT, which sends the message again over the same stored message
+	_, _ = scheduledHandler.SetScheduledMessageStatus(scheduled, status)
+	_ = scheduledHandler.RemoveScheduledMessageFromAccount(scheduled)
+}
+
+// sendExpiries sends the expiry events of the messages which expired after "after", and returns until when they were
+// sent.
+func (s *SchedulerService) sendExpiries(manager *manager.ConnectionManager, after time.Time) time.Time {
+	expiryHandler := handler.NewMessageExpiryHandler(s.db)
+	now := time.Now().UTC()
+	for bucket := after.Truncate(time.Hour); !bucket.After(now); bucket = bucket.Add(time.Hour) {
+		expiries, err := expiryHandler.GetMessageExpiries(bucket, after, now)
+		if err != nil {
+			// retry the whole range on the next tick
+			return after
+		}
+		for i := range expiries {
+			manager.SendMessageExpiry(&expiries[i])
+			// every instance tries, removing a file twice is harmless
+			_ = manager.RemoveExpiredFile(&expiries[i])
+		}
+	}
+	return now
+}
+
+// removeExpiredUploads removes the chunks of the uploads which expired from the bucket of "from" until now, and returns
+// the first bucket which may still hold some.
+func (s *SchedulerService) removeExpiredUploads(manager *manager.ConnectionManager, from time.Time) time.Time {
+	uploadHandler := handler.NewFileUploadHandler(s.db)
+	now := time.Now().UTC()
+	from = from.UTC().Truncate(time.Hour)
+	for bucket := from; !bucket.After(now); bucket = bucket.Add(time.Hour) {
+		expiries, err := uploadHandler.GetExpiredUploads(bucket, now)
+		if err != nil {
+			return from
+		}
+		for i := range expiries {
+			// the expiry is kept for the next tick until every chunk is removed
+			if manager.RemoveExpiredUpload(&expiries[i]) != nil || uploadHandler.RemoveUploadExpiry(&expiries[i]) != nil {
+				return from
+			}
+		}
+		from = bucket.Add(time.Hour)
+	}
+	// the current bucket gets more expired uploads until the hour ends
+	return now.Truncate(time.Hour)
+}
+
+// removeExpiredUnreadCounts decrements the unread counts of the notifications which expired from the bucket of "from"
+// until now, and returns the first bucket which may still hold some.
+func (s *SchedulerService) removeExpiredUnreadCounts(manager *manager.ConnectionManager, from time.Time) time.Time {
+	notificationHandler := handler.NewNotificationHandler(s.db)
+	now := time.Now().UTC()
+	from = from.UTC().Truncate(time.Hour)
+	for bucket := from; !bucket.After(now); bucket = bucket.Add(time.Hour) {
+		expiries, err := notificationHandler.GetExpiredUnreadCounts(bucket, now)
+		if err != nil {
+			return from
+		}
+		for i := range expiries {
+			// a failed claim is retried on the next tick
+			if manager.RemoveExpiredUnreadCount(&expiries[i]) != nil {
+				return from
+			}
+		}
+		from = bucket.Add(time.Hour)
+	}
+	// the current bucket gets more expired unread counts until the hour ends
+	return now.Truncate(time.Hour)
+}
@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3Service         = "s3"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3DateFormat      = "20060102"
+	s3DateTimeFormat  = "20060102T150405Z"
+)
+
+// S3Store stores objects in a bucket of an S3-compatible service (AWS S3, MinIO, ...).
+//
+// Requests use path-style URLs (<endpoint>/<bucket>/<key>) and are signed with AWS Signature Version 4. Payloads are not
+// signed, so that objects can be streamed; use an https endpoint.
+type S3Store struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func NewS3Store(endpoint string, region string, bucket string, accessKey string, secretKey string) (*S3Store, error) {
+	if endpoint == "" || bucket == "" || accessKey == "" || secretKey == "" {
+		return nil, errors.New("the S3 object store needs an endpoint, a bucket and credentials")
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || endpointURL.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Store{
+		endpoint:  endpointURL,
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{},
+	}, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	req, err := s.newRequest(ctx, http.MethodPut, key, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *S3Store) newRequest(ctx context.Context, method string, key string, body io.Reader) (*http.Request, error) {
+	objectURL := *s.endpoint
+	objectURL.Path = strings.TrimSuffix(objectURL.Path, "/") + "/" + s.bucket + "/" + strings.TrimPrefix(key, "/")
+	objectURL.RawPath = s3Escape(objectURL.Path, true)
+	return http.NewRequestWithContext(ctx, method, objectURL.String(), body)
+}
+
+// do signs and sends the request, and turns error statuses into errors. The body of a successful response must be
+// closed by the caller.
+func (s *S3Store) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrObjectNotFound
+	}
+	details, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("S3 %s %s failed with status %s: %s", req.Method, req.URL.Path, resp.Status, details)
+}
+
+// sign adds the AWS Signature Version 4 headers to the request.
+func (s *S3Store) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format(s3DateTimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": s3UnsignedPayload,
+		"x-amz-date":           amzDate,
+	}
+	canonicalRequest, signedHeaders := s3CanonicalRequest(req.Method, req.URL.EscapedPath(), req.URL.Query(), headers, s3UnsignedPayload)
+	scope := s3Scope(now, s.region)
+	signature := s3Signature(s.secretKey, now, s.region, s3StringToSign(now, scope, canonicalRequest))
+	req.Header.Set("Authorization", s3Algorithm+" Credential="+s.accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// s3CanonicalRequest returns the canonical request of Signature Version 4, and the list of its signed headers.
+// The header names must be lowercase.
+func s3CanonicalRequest(method string, escapedPath string, query url.Values, headers map[string]string, payloadHash string) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parameters := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parameters = append(parameters, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	signedHeaders := strings.Join(names, ";")
+	return strings.Join([]string{
+		method,
+		escapedPath,
+		strings.Join(parameters, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n"), signedHeaders
+}
+
+func s3Scope(now time.Time, region string) string {
+	return now.Format(s3DateFormat) + "/" + region + "/" + s3Service + "/aws4_request"
+}
+
+func s3StringToSign(now time.Time, scope string, canonicalRequest string) string {
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	return s3Algorithm + "\n" + now.Format(s3DateTimeFormat) + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+}
+
+func s3Signature(secretKey string, now time.Time, region string, stringToSign string) string {
+	signingKey := hmacSHA256([]byte("AWS4"+secretKey), now.Format(s3DateFormat))
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, s3Service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes a string the way Signature Version 4 expects: every byte except unreserved characters, and
+// slashes in paths.
+func s3Escape(value string, path bool) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	conf "github.com/khanhnguyen02311/EchoChat-WS/configurations"
+	"io"
+)
+
+const (
+	StoreLocal = "local"
+	StoreS3    = "s3"
+)
+
+var ErrObjectNotFound = errors.New("object not found")
+
+// An ObjectStore stores blobs (uploaded files and their chunks) by key.
+//
+// Keys are slash-separated paths generated by the server, e.g. "files/<id>".
+type ObjectStore interface {
+	// Put stores size bytes read from body under key, replacing any existing object.
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	// Get opens the object stored under key, or returns ErrObjectNotFound.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// NewObjectStore returns the object store selected by UPLOAD_STORE, the local filesystem by default.
+func NewObjectStore() (ObjectStore, error) {
+	switch conf.UPLOAD_STORE {
+	case "", StoreLocal:
+		return NewLocalStore(conf.UPLOAD_LOCAL_DIR)
+	case StoreS3:
+		return NewS3Store(conf.UPLOAD_S3_ENDPOINT, conf.UPLOAD_S3_REGION, conf.UPLOAD_S3_BUCKET, conf.UPLOAD_S3_ACCESS_KEY, conf.UPLOAD_S3_SECRET_KEY)
+	default:
+		return nil, fmt.Errorf("unknown object store %q (must be one of [%q %q])", conf.UPLOAD_STORE, StoreLocal, StoreS3)
+	}
+}
+
+// FileKey returns the key of an uploaded file.
+func FileKey(id string) string {
+	return "files/" + id
+}
+
+// PartKey returns the key of a chunk of a file being uploaded, chunks being numbered from 0.
+func PartKey(id string, index int64) string {
+	return fmt.Sprintf("parts/%s/%08d", id, index)
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/joho/godotenv"
 	"os"
 	"strconv"
+	"time"
 )
 
 var (
@@ -23,8 +24,63 @@ var (
 	SCYLLA_HOST     string
 	SCYLLA_PORT     int
 	SCYLLA_KEYSPACE string
+
+	WS_PING_INTERVAL time.Duration
+	WS_PONG_WAIT     time.Duration
+	WS_WRITE_WAIT    time.Duration
+
+	WS_SEND_QUEUE_SIZE    int
+	WS_SEND_QUEUE_POLICY  string
+	WS_INBOUND_QUEUE_SIZE int
+
+	WS_SESSION_BUFFER_SIZE int
+	WS_SESSION_TTL         time.Duration
+
+	WS_TYPING_TIMEOUT  time.Duration
+	WS_TYPING_THROTTLE time.Duration
+
+	WS_PRESENCE_GRACE time.Duration
+
+	MESSAGE_DEDUPE_TTL time.Duration
+
+	PARTICIPANT_ROLE_ADMIN string
+
+	SCHEDULER_INTERVAL      time.Duration
+	SCHEDULER_LOOKBACK      time.Duration
+	SCHEDULER_CLAIM_TIMEOUT time.Duration
+
+	UPLOAD_STORE          string
+	UPLOAD_LOCAL_DIR      string
+	UPLOAD_MAX_SIZE       int
+	UPLOAD_CHUNK_SIZE     int
+	UPLOAD_TTL            time.Duration
+	UPLOAD_COMMIT_TIMEOUT time.Duration
+
+	UPLOAD_S3_ENDPOINT   string
+	UPLOAD_S3_REGION     string
+	UPLOAD_S3_BUCKET     string
+	UPLOAD_S3_ACCESS_KEY string
+	UPLOAD_S3_SECRET_KEY string
 )
 
+// getEnvDuration parses a duration variable (e.g. "30s"), falling back to defaultValue when it is missing or invalid.
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvInt parses an integer variable, falling back to defaultValue when it is missing, invalid or not positive.
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
 func InitEnv(envFile string) error {
 	if envFile != "" {
 		err := godotenv.Load(envFile)
@@ -48,6 +104,65 @@ func InitEnv(envFile string) error {
 	SCYLLA_PORT, _ = strconv.Atoi(os.Getenv("SCYLLA_PORT"))
 	SCYLLA_KEYSPACE = os.Getenv("SCYLLA_KEYSPACE")
 
+	WS_PING_INTERVAL = getEnvDuration("WS_PING_INTERVAL", 30*time.Second)
+	WS_PONG_WAIT = getEnvDuration("WS_PONG_WAIT", 60*time.Second)
+	WS_WRITE_WAIT = getEnvDuration("WS_WRITE_WAIT", 10*time.Second)
+	if WS_PING_INTERVAL >= WS_PONG_WAIT {
+		// pings must be sent before the read deadline of the connection expires
+		WS_PING_INTERVAL = WS_PONG_WAIT * 9 / 10
+	}
+
+	WS_SEND_QUEUE_SIZE = getEnvInt("WS_SEND_QUEUE_SIZE", 256)
+	WS_SEND_QUEUE_POLICY = os.Getenv("WS_SEND_QUEUE_POLICY")
+	switch WS_SEND_QUEUE_POLICY {
+	case "":
+		WS_SEND_QUEUE_POLICY = "drop-oldest"
+	case "drop-oldest", "drop-newest", "disconnect": // see connection.SendQueuePolicy*
+	default:
+		return fmt.Errorf("invalid WS_SEND_QUEUE_POLICY %q (must be one of [drop-oldest drop-newest disconnect])", WS_SEND_QUEUE_POLICY)
+	}
+	WS_INBOUND_QUEUE_SIZE = getEnvInt("WS_INBOUND_QUEUE_SIZE", 32)
+
+	WS_SESSION_BUFFER_SIZE = getEnvInt("WS_SESSION_BUFFER_SIZE", 128)
+	WS_SESSION_TTL = getEnvDuration("WS_SESSION_TTL", 2*time.Minute)
+	if WS_SESSION_BUFFER_SIZE >= WS_SEND_QUEUE_SIZE {
+		// a resync replays the whole buffer into the send queue of the new connection, which must not drop any of it
+		return fmt.Errorf("WS_SESSION_BUFFER_SIZE (%d) must be lower than WS_SEND_QUEUE_SIZE (%d)", WS_SESSION_BUFFER_SIZE, WS_SEND_QUEUE_SIZE)
+	}
+
+	WS_TYPING_TIMEOUT = getEnvDuration("WS_TYPING_TIMEOUT", 6*time.Second)
+	WS_TYPING_THROTTLE = getEnvDuration("WS_TYPING_THROTTLE", 2*time.Second)
+
+	WS_PRESENCE_GRACE = getEnvDuration("WS_PRESENCE_GRACE", 10*time.Second)
+
+	MESSAGE_DEDUPE_TTL = getEnvDuration("MESSAGE_DEDUPE_TTL", 24*time.Hour)
+
+	// the roles are written by the EchoChat backend, this module only recognizes its admins
+	PARTICIPANT_ROLE_ADMIN = os.Getenv("PARTICIPANT_ROLE_ADMIN")
+	if PARTICIPANT_ROLE_ADMIN == "" {
+		PARTICIPANT_ROLE_ADMIN = "Admin"
+	}
+
+	SCHEDULER_INTERVAL = getEnvDuration("SCHEDULER_INTERVAL", 5*time.Second)
+	SCHEDULER_LOOKBACK = getEnvDuration("SCHEDULER_LOOKBACK", 24*time.Hour)
+	SCHEDULER_CLAIM_TIMEOUT = getEnvDuration("SCHEDULER_CLAIM_TIMEOUT", time.Minute)
+
+	UPLOAD_STORE = os.Getenv("UPLOAD_STORE")
+	UPLOAD_LOCAL_DIR = os.Getenv("UPLOAD_LOCAL_DIR")
+	if UPLOAD_LOCAL_DIR == "" {
+		UPLOAD_LOCAL_DIR = "uploads"
+	}
+	UPLOAD_MAX_SIZE = getEnvInt("UPLOAD_MAX_SIZE", 50<<20)
+	UPLOAD_CHUNK_SIZE = getEnvInt("UPLOAD_CHUNK_SIZE", 256<<10)
+	UPLOAD_TTL = getEnvDuration("UPLOAD_TTL", 24*time.Hour)
+	UPLOAD_COMMIT_TIMEOUT = getEnvDuration("UPLOAD_COMMIT_TIMEOUT", 5*time.Minute)
+
+	UPLOAD_S3_ENDPOINT = os.Getenv("UPLOAD_S3_ENDPOINT")
+	UPLOAD_S3_REGION = os.Getenv("UPLOAD_S3_REGION")
+	UPLOAD_S3_BUCKET = os.Getenv("UPLOAD_S3_BUCKET")
+	UPLOAD_S3_ACCESS_KEY = os.Getenv("UPLOAD_S3_ACCESS_KEY")
+	UPLOAD_S3_SECRET_KEY = os.Getenv("UPLOAD_S3_SECRET_KEY")
+
 	fmt.Printf("Environment variables loaded successfully. Application port: %s\n", APP_PORT)
 	return nil
 }
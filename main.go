@@ -10,6 +10,8 @@ import (
 	"github.com/khanhnguyen02311/EchoChat-WS/components/manager/connection"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/manager/message"
 	"github.com/khanhnguyen02311/EchoChat-WS/components/services/rabbitmq"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/services/scheduler"
+	"github.com/khanhnguyen02311/EchoChat-WS/components/services/storage"
 	"github.com/khanhnguyen02311/EchoChat-WS/configurations"
 	"github.com/labstack/echo-contrib/echoprometheus"
 	"github.com/labstack/echo/v4"
@@ -28,6 +30,11 @@ var (
 		Name:      "successful_websocket_connections_total",
 		Help:      "Total number of successful WebSocket connections",
 	})
+	ReapedConnectionCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Subsystem: "echo_ws",
+		Name:      "reaped_websocket_connections_total",
+		Help:      "Total number of WebSocket connections closed because the peer stopped answering heartbeats",
+	})
 	MessageReceivedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Subsystem: "echo_ws",
 		Name:      "messages_received_total",
@@ -38,28 +45,43 @@ var (
 		Name:      "messages_sent_total",
 		Help:      "Total number of messages sent, separated by type",
 	}, []string{"type"})
+	SendQueueDepthGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "echo_ws",
+		Name:      "send_queue_depth",
+		Help:      "Number of messages waiting in the outbound queues of all connections",
+	})
+	SendQueueDroppedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "echo_ws",
+		Name:      "send_queue_dropped_total",
+		Help:      "Total number of outbound messages dropped because a send queue was full, separated by overflow policy",
+	}, []string{"policy"})
 	// Custom prometheus metrics
 
 	e *echo.Echo
 	m *manager.ConnectionManager
 )
 
+func writeErrorResponse(conn *connection.WSConnection, requestID string, err error) {
+	response := message.NewOutputMessage(
+		message.MsgTypeResponse,
+		message.MsgStatusError,
+		err.Error())
+	response.RequestID = requestID
+	_ = conn.WriteJSONMessage(response)
+	MessageSentCounter.WithLabelValues(message.MsgTypeResponse + "-" + message.MsgStatusError).Inc()
+}
+
 func handleMessage(c echo.Context, conn *connection.WSConnection, msg *message.InputMessage) {
-	err := m.ProcessInputMessage(conn, msg)
+	response, err := m.ProcessInputMessage(conn, msg)
 	if err != nil {
 		c.Logger().Error(err)
-		_ = conn.WriteJSONMessage(message.NewOutputMessage(
-			message.MsgTypeResponse,
-			message.MsgStatusError,
-			err.Error()))
-		MessageSentCounter.WithLabelValues(message.MsgTypeResponse + "-" + message.MsgStatusError).Inc()
+		writeErrorResponse(conn, msg.RequestID, err)
 		return
 	}
-	_ = conn.WriteJSONMessage(message.NewOutputMessage(
-		message.MsgTypeResponse,
-		message.MsgStatusSuccess,
-		""))
-	MessageSentCounter.WithLabelValues(message.MsgTypeResponse + "-" + message.MsgStatusSuccess).Inc()
+	response.RequestID = msg.RequestID
+	_ = conn.WriteJSONMessage(response)
+	// a partly failed request answers with an error status, along with what was done
+	MessageSentCounter.WithLabelValues(message.MsgTypeResponse + "-" + response.Status).Inc()
 }
 
 func initWS(c echo.Context) error {
@@ -71,24 +93,30 @@ func initWS(c echo.Context) error {
 	}
 	SuccessfulConnectionCounter.Inc()
 	defer m.RemoveConnection(conn)
+	conn.StartProcessor(func(msg *message.InputMessage) {
+		handleMessage(c, conn, msg)
+	})
 	for {
 		msg, err := conn.ReadJSONMessage()
 		if err != nil {
+			var invalidErr *connection.InvalidMessageError
+			if errors.As(err, &invalidErr) {
+				writeErrorResponse(conn, invalidErr.RequestID, err)
+				continue
+			}
 			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
 				c.Logger().Info("Connection closed: ", err.Error())
-				break
+			} else if connection.IsTimeoutError(err) || conn.Reaped() {
+				c.Logger().Info("Connection reaped after missing heartbeats: ", err.Error())
+				ReapedConnectionCounter.Inc()
 			} else if websocket.IsUnexpectedCloseError(err) {
 				c.Logger().Error("Unexpected close error: ", err.Error())
-				break
 			} else {
-				_ = conn.WriteJSONMessage(message.NewOutputMessage(
-					message.MsgTypeResponse,
-					message.MsgStatusError,
-					err.Error()))
-				MessageSentCounter.WithLabelValues(message.MsgTypeResponse + "-" + message.MsgStatusError).Inc()
+				c.Logger().Error("Connection read error: ", err.Error())
 			}
-		} else {
-			go handleMessage(c, conn, msg)
+			break
+		} else if err := conn.Dispatch(msg); err != nil {
+			writeErrorResponse(conn, msg.RequestID, err)
 		}
 	}
 	return nil
@@ -121,32 +149,87 @@ func main() {
 		return
 	}
 	//dbSession.Test()
+	store, err := storage.NewObjectStore()
+	if err != nil {
+		fmt.Println("Error opening the object store:", err.Error())
+		return
+	}
 	e = echo.New()
-	m = manager.NewConnectionManager(e, dbSession, MessageSentCounter, MessageReceivedCounter)
+	m = manager.NewConnectionManager(e, dbSession, store, MessageSentCounter, MessageReceivedCounter, SendQueueDepthGauge, SendQueueDroppedCounter)
 	rmq, err := rabbitmq.NewRMQService()
 	if err != nil {
 		fmt.Println("Error connecting to RabbitMQ:", err.Error())
 		return
 	}
+	sch := scheduler.NewSchedulerService(dbSession)
 
 	// register custom prometheus metrics
 	if err := prometheus.Register(SuccessfulConnectionCounter); err != nil {
 		log.Fatal(err)
 	}
+	if err := prometheus.Register(ReapedConnectionCounter); err != nil {
+		log.Fatal(err)
+	}
 	if err := prometheus.Register(MessageSentCounter); err != nil {
 		log.Fatal(err)
 	}
 	if err := prometheus.Register(MessageReceivedCounter); err != nil {
 		log.Fatal(err)
 	}
+	if err := prometheus.Register(SendQueueDepthGauge); err != nil {
+		log.Fatal(err)
+	}
+	if err := prometheus.Register(SendQueueDroppedCounter); err != nil {
+		log.Fatal(err)
+	}
 
 	// pre-load counter labels
 	SuccessfulConnectionCounter.Add(0)
+	ReapedConnectionCounter.Add(0)
 	MessageSentCounter.WithLabelValues(message.MsgTypeResponse + "-" + message.MsgStatusError).Add(0)
 	MessageSentCounter.WithLabelValues(message.MsgTypeResponse + "-" + message.MsgStatusSuccess).Add(0)
 	MessageSentCounter.WithLabelValues(message.MsgTypeNotification).Add(0)
+	MessageSentCounter.WithLabelValues(message.MsgTypeMessage).Add(0)
+	MessageSentCounter.WithLabelValues(message.MsgTypeSession).Add(0)
+	MessageSentCounter.WithLabelValues(message.MsgTypeReaction).Add(0)
+	MessageSentCounter.WithLabelValues(message.MsgTypeReadReceipt).Add(0)
+	MessageSentCounter.WithLabelValues(message.MsgTypeUnreadSummary).Add(0)
+	MessageSentCounter.WithLabelValues(message.MsgTypePin).Add(0)
+	MessageSentCounter.WithLabelValues(message.MsgTypePoll).Add(0)
+	MessageSentCounter.WithLabelValues(message.MsgTypeTyping).Add(0)
+	MessageSentCounter.WithLabelValues(message.MsgTypePresence).Add(0)
 	MessageReceivedCounter.WithLabelValues(message.MsgTypeMessageNew).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeMessageForward).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeUploadBegin).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeUploadChunk).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeUploadCommit).Add(0)
 	MessageReceivedCounter.WithLabelValues(message.MsgTypeNotificationRead).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeNotificationList).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeNotificationReadAll).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeGroupMute).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeGroupUnmute).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeGroupFocus).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeGroupRetention).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeMessagePin).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeMessageUnpin).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypePinsList).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypePollVote).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeScheduledList).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeScheduledCancel).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeMessageHistory).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeMessageThread).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeMessageEdit).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeMessageDelete).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeReactionAdd).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeReactionRemove).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeMessageDelivered).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeMessageRead).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeTypingStart).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypeTypingStop).Add(0)
+	MessageReceivedCounter.WithLabelValues(message.MsgTypePresenceQuery).Add(0)
+	SendQueueDroppedCounter.WithLabelValues(connection.SendQueuePolicyDropOldest).Add(0)
+	SendQueueDroppedCounter.WithLabelValues(connection.SendQueuePolicyDropNewest).Add(0)
+	SendQueueDroppedCounter.WithLabelValues(connection.SendQueuePolicyDisconnect).Add(0)
 
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
@@ -155,10 +238,12 @@ func main() {
 	e.GET("/metrics", echoprometheus.NewHandler()) // default handler
 	e.GET("/ws", initWS)
 
-	// Start the RabbitMQ consumer and the Echo server
+	// Start the RabbitMQ consumer, the message scheduler and the Echo server
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go rmq.StartConsuming(ctx, m, &wg)
+	wg.Add(1)
+	sch.StartScheduling(ctx, m, &wg)
 	go func() {
 		if err := e.Start("0.0.0.0:" + configurations.APP_PORT); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal(err)
@@ -169,7 +254,7 @@ func main() {
 	signal.Notify(sig, os.Interrupt)
 	select {
 	case <-sig:
-		// Shutdown signal received, cancel the context to signal the RabbitMQ consumer to finish
+		// Shutdown signal received, cancel the context to signal the RabbitMQ consumer and the scheduler to finish
 		fmt.Println("Shutting down...")
 		cancel()
 		rmq.Close()